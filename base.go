@@ -0,0 +1,63 @@
+package charm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Base identifies an operating system and release using the
+// "os@channel" form favoured by newer charm tooling (e.g.
+// "ubuntu@22.04"), as an alternative to the older series-based
+// identifiers such as "jammy".
+type Base struct {
+	Name    string
+	Channel string
+}
+
+// ubuntuSeriesByChannel maps the channel component of an Ubuntu base
+// onto the series name historically used throughout this package.
+var ubuntuSeriesByChannel = map[string]string{
+	"12.04": "precise",
+	"14.04": "trusty",
+	"16.04": "xenial",
+	"18.04": "bionic",
+	"20.04": "focal",
+	"22.04": "jammy",
+	"23.04": "lunar",
+	"23.10": "mantic",
+	"24.04": "noble",
+}
+
+// ParseBase parses a base string in the form "os@channel", for
+// example "ubuntu@22.04".
+func ParseBase(s string) (Base, error) {
+	i := strings.Index(s, "@")
+	if i <= 0 || i == len(s)-1 {
+		return Base{}, fmt.Errorf("expected base string in the form %q, got %q", "os@channel", s)
+	}
+	return Base{Name: s[:i], Channel: s[i+1:]}, nil
+}
+
+// Series returns the series name that corresponds to the base, for
+// use by code that has not yet been converted to work in terms of
+// bases. It currently only knows how to convert Ubuntu bases.
+func (b Base) Series() (string, error) {
+	if b.Name != "ubuntu" {
+		return "", fmt.Errorf("cannot determine series for base os %q", b.Name)
+	}
+	series, ok := ubuntuSeriesByChannel[b.Channel]
+	if !ok {
+		return "", fmt.Errorf("unknown ubuntu base channel %q", b.Channel)
+	}
+	return series, nil
+}
+
+// Empty reports whether b is the zero Base.
+func (b Base) Empty() bool {
+	return b.Name == "" && b.Channel == ""
+}
+
+// String returns the "os@channel" form of the base.
+func (b Base) String() string {
+	return fmt.Sprintf("%s@%s", b.Name, b.Channel)
+}
@@ -0,0 +1,492 @@
+package bundlechanges
+
+import (
+	"fmt"
+	"sort"
+
+	"gopkg.in/juju/charm.v2"
+)
+
+// FromData returns the ordered set of changes needed to deploy the
+// given bundle data, reusing whatever services, units and machines
+// are already present in existing. If existing is nil, it is treated
+// as an empty model.
+//
+// The returned changes are ordered so that a change never appears
+// before any change listed in its Requires; that is, they form a
+// valid topological order of the implied dependency graph.
+func FromData(bd *charm.BundleData, existing *Model) ([]Change, error) {
+	if err := bd.Verify(nil, nil, nil); err != nil {
+		return nil, fmt.Errorf("cannot build changes for invalid bundle: %v", err)
+	}
+	b := &builder{
+		bd:         bd,
+		existing:   existing,
+		counts:     make(map[string]int),
+		charmIds:   make(map[string]string),
+		machineIds: make(map[string]string),
+		serviceIds: make(map[string]string),
+	}
+	b.addCharms()
+	b.addMachines()
+	b.addServices()
+	if err := b.addUnits(); err != nil {
+		return nil, err
+	}
+	b.addRelations()
+	b.addAnnotations()
+	b.addExposed()
+	b.addOptionsAndConstraints()
+	return b.changes, nil
+}
+
+// builder holds the state accumulated while building the change set
+// for a single call to FromData.
+type builder struct {
+	bd       *charm.BundleData
+	existing *Model
+	changes  []Change
+
+	// counts holds the number of changes already created for each
+	// RPC method, used to generate change ids such as "deploy-0".
+	counts map[string]int
+
+	// charmIds maps a charm URL to the id of the AddCharmChange
+	// that adds it, so that the same charm is never added twice.
+	charmIds map[string]string
+
+	// machineIds maps a bundle machine id to the id of the change
+	// that creates it, or to the machine id itself if the machine
+	// already exists in the model.
+	machineIds map[string]string
+
+	// serviceIds maps a bundle service name to the id of the
+	// change that creates it, or to the service name itself if the
+	// service already exists in the model.
+	serviceIds map[string]string
+
+	// unitChanges maps a bundle service name to the AddUnitChange
+	// for each of its new units, indexed by unit index. A nil map
+	// value means the service's units have started being built but
+	// are not finished, used to detect placement cycles.
+	unitChanges map[string]map[int]*AddUnitChange
+}
+
+// newId returns a new, unique id for a change produced by the given
+// RPC method.
+func (b *builder) newId(method string) string {
+	id := fmt.Sprintf("%s-%d", method, b.counts[method])
+	b.counts[method]++
+	return id
+}
+
+func (b *builder) add(c Change) {
+	b.changes = append(b.changes, c)
+}
+
+// sortedServiceNames returns the names of the bundle's services in a
+// stable order, so that the same bundle always produces the same
+// change set.
+func (b *builder) sortedServiceNames() []string {
+	names := make([]string, 0, len(b.bd.Services))
+	for name := range b.bd.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (b *builder) sortedMachineIds() []string {
+	ids := make([]string, 0, len(b.bd.Machines))
+	for id := range b.bd.Machines {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// addCharms adds an AddCharmChange for every distinct charm URL used
+// by the bundle's services.
+func (b *builder) addCharms() {
+	for _, name := range b.sortedServiceNames() {
+		url := b.bd.Services[name].Charm
+		if _, ok := b.charmIds[url]; ok {
+			continue
+		}
+		id := b.newId("addCharm")
+		b.add(&AddCharmChange{
+			changeInfo: changeInfo{id: id},
+			CharmURL:   url,
+		})
+		b.charmIds[url] = id
+	}
+}
+
+// addMachines adds an AddMachineChange for every machine explicitly
+// declared in the bundle that is not already present in the model.
+func (b *builder) addMachines() {
+	for _, id := range b.sortedMachineIds() {
+		if m := b.existing.machine(id); m != nil {
+			b.machineIds[id] = id
+			continue
+		}
+		spec := b.bd.Machines[id]
+		series, base := "", ""
+		if spec != nil {
+			series, base = spec.Series, spec.Base
+		}
+		if series == "" && base == "" {
+			series = b.bd.Series
+			base = b.bd.DefaultBase
+		}
+		change := &AddMachineChange{
+			changeInfo: changeInfo{id: b.newId("addMachines")},
+			Series:     series,
+			Base:       base,
+		}
+		if spec != nil {
+			change.Constraints = spec.Constraints
+		}
+		b.add(change)
+		b.machineIds[id] = change.Id()
+	}
+}
+
+// addServices adds an AddServiceChange for every service declared in
+// the bundle that is not already deployed in the model.
+func (b *builder) addServices() {
+	for _, name := range b.sortedServiceNames() {
+		svc := b.bd.Services[name]
+		if existing := b.existing.service(name); existing != nil {
+			b.serviceIds[name] = name
+			continue
+		}
+		series, base := svc.Series, svc.Base
+		if series == "" && base == "" {
+			series, base = b.bd.Series, b.bd.DefaultBase
+		}
+		if series == "" && base != "" {
+			// AddServiceChange carries a series only, so resolve
+			// the base to one.
+			if parsed, err := charm.ParseBase(base); err == nil {
+				series, _ = parsed.Series()
+			}
+		}
+		change := &AddServiceChange{
+			changeInfo:  changeInfo{id: b.newId("deploy"), requires: []string{b.charmIds[svc.Charm]}},
+			Charm:       b.charmIds[svc.Charm],
+			Service:     name,
+			Series:      series,
+			Options:     svc.Options,
+			Constraints: svc.Constraints,
+		}
+		b.add(change)
+		b.serviceIds[name] = change.Id()
+	}
+}
+
+// addUnits adds an AddUnitChange for every unit that still needs to
+// be created to bring each service up to its declared NumUnits,
+// creating any machines implied by unit placement along the way.
+func (b *builder) addUnits() error {
+	b.unitChanges = make(map[string]map[int]*AddUnitChange)
+	for _, name := range b.sortedServiceNames() {
+		if err := b.ensureUnits(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureUnits creates the AddUnitChange entries for service, if it
+// has not already been processed. It is called both from addUnits
+// and recursively from placementFor, so that a placement directive
+// may refer to a service regardless of name ordering.
+func (b *builder) ensureUnits(name string) error {
+	if units, ok := b.unitChanges[name]; ok {
+		if units == nil {
+			return fmt.Errorf("cannot resolve placement: service %q is involved in a placement cycle", name)
+		}
+		return nil
+	}
+	svc, ok := b.bd.Services[name]
+	if !ok {
+		return fmt.Errorf("placement refers to service %q not defined in this bundle", name)
+	}
+	b.unitChanges[name] = nil
+	units := make(map[int]*AddUnitChange)
+	existingUnits := 0
+	if existing := b.existing.service(name); existing != nil {
+		existingUnits = len(existing.Units)
+	}
+	serviceId := b.serviceIds[name]
+	serviceIsChange := serviceId != name
+	for i := existingUnits; i < svc.NumUnits; i++ {
+		to, toIsChange, err := b.placementFor(svc, i)
+		if err != nil {
+			return err
+		}
+		change := &AddUnitChange{
+			changeInfo:      changeInfo{id: b.newId("addUnit"), requires: b.requiresFor(serviceId, serviceIsChange, to, toIsChange)},
+			Service:         name,
+			serviceIsChange: serviceIsChange,
+			To:              to,
+			toIsChange:      toIsChange,
+		}
+		b.add(change)
+		units[i] = change
+	}
+	b.unitChanges[name] = units
+	return nil
+}
+
+// requiresFor returns the ids that an AddUnitChange must wait on:
+// the change (if any) that creates the owning service, plus the
+// change (if any) referred to by a placement directive. serviceId
+// and to may each hold either a change id or the name/id of an
+// already-existing entity; serviceIsChange and toIsChange report
+// which is the case.
+func (b *builder) requiresFor(serviceId string, serviceIsChange bool, to string, toIsChange bool) []string {
+	var requires []string
+	if serviceIsChange {
+		requires = append(requires, serviceId)
+	}
+	if to != "" && toIsChange {
+		requires = append(requires, to)
+	}
+	return requires
+}
+
+// placementFor resolves the "to" placement directive for the i'th
+// new unit of svc into either the id of a change that will create
+// the hosting machine or co-located unit, or an already-existing
+// machine id; the second return value reports which is the case. If
+// no particular placement was requested, it creates a new machine for
+// the unit and returns the id of that change.
+func (b *builder) placementFor(svc *charm.ServiceSpec, i int) (string, bool, error) {
+	var directive string
+	switch {
+	case len(svc.To) == 0:
+		// No placement: each unit gets its own new machine.
+		return b.newMachine("", "", false).Id(), true, nil
+	case i < len(svc.To):
+		directive = svc.To[i]
+	default:
+		directive = svc.To[len(svc.To)-1]
+	}
+	up, err := charm.ParsePlacement(directive)
+	if err != nil {
+		return "", false, fmt.Errorf("cannot parse placement %q: %v", directive, err)
+	}
+	switch {
+	case up.Machine == "new":
+		if up.ContainerType == "" {
+			return b.newMachine("", "", false).Id(), true, nil
+		}
+		// The container needs an actual host machine to run on;
+		// "new" never refers to one that already exists.
+		host := b.newMachine("", "", false)
+		return b.newMachine(up.ContainerType, host.Id(), true).Id(), true, nil
+	case up.Machine != "":
+		parent, ok := b.machineIds[up.Machine]
+		if !ok {
+			// The placement refers to a machine that the bundle
+			// did not declare explicitly; create it implicitly.
+			parent = b.newMachine("", "", false).Id()
+			b.machineIds[up.Machine] = parent
+		}
+		parentIsChange := parent != up.Machine
+		if up.ContainerType == "" {
+			return parent, parentIsChange, nil
+		}
+		return b.newMachine(up.ContainerType, parent, parentIsChange).Id(), true, nil
+	default:
+		// Co-located with a unit of another service.
+		unitChange, err := b.unitFor(up.Service, up.Unit)
+		if err != nil {
+			return "", false, err
+		}
+		if up.ContainerType == "" {
+			return unitChange.Id(), true, nil
+		}
+		return b.newMachine(up.ContainerType, unitChange.Id(), true).Id(), true, nil
+	}
+}
+
+// newMachine records and returns a change that creates a new machine
+// or container. containerType and parentId are empty for a
+// top-level machine. parentId may hold either the id of a change
+// that will create the host machine or unit, or an existing machine
+// id; parentIsChange reports which is the case, and is meaningless
+// when parentId is empty.
+func (b *builder) newMachine(containerType, parentId string, parentIsChange bool) *AddMachineChange {
+	change := &AddMachineChange{
+		changeInfo:     changeInfo{id: b.newId("addMachines")},
+		Series:         b.bd.Series,
+		Base:           b.bd.DefaultBase,
+		ContainerType:  containerType,
+		ParentId:       parentId,
+		parentIsChange: parentIsChange,
+	}
+	if parentId != "" && parentIsChange {
+		change.changeInfo.requires = []string{parentId}
+	}
+	b.add(change)
+	return change
+}
+
+// unitFor returns the change that adds the given unit index of
+// service, creating the service's remaining units ahead of schedule
+// if the placement refers to a unit that has not been reached yet in
+// service name order. unit may be -1, meaning any unit of the
+// service; in that case the first unit is used.
+func (b *builder) unitFor(service string, unit int) (*AddUnitChange, error) {
+	if unit < 0 {
+		unit = 0
+	}
+	if err := b.ensureUnits(service); err != nil {
+		return nil, err
+	}
+	if change, ok := b.unitChanges[service][unit]; ok {
+		return change, nil
+	}
+	return nil, fmt.Errorf("placement refers to unit %d of service %q which is not created by the bundle", unit, service)
+}
+
+// addRelations adds an AddRelationChange for every relation declared
+// by the bundle.
+func (b *builder) addRelations() {
+	for _, rel := range b.bd.Relations {
+		ep1, ep2 := rel[0], rel[1]
+		var requires []string
+		if id := b.serviceIds[serviceName(ep1)]; id != serviceName(ep1) {
+			requires = append(requires, id)
+		}
+		if id := b.serviceIds[serviceName(ep2)]; id != serviceName(ep2) {
+			requires = append(requires, id)
+		}
+		b.add(&AddRelationChange{
+			changeInfo: changeInfo{id: b.newId("addRelation"), requires: requires},
+			Endpoint1:  ep1,
+			Endpoint2:  ep2,
+		})
+	}
+}
+
+// serviceName returns the service part of a "service:relation"
+// endpoint string.
+func serviceName(endpoint string) string {
+	for i, r := range endpoint {
+		if r == ':' {
+			return endpoint[:i]
+		}
+	}
+	return endpoint
+}
+
+// addAnnotations adds a SetAnnotationsChange for every service or
+// machine that declares annotations and is being newly created.
+func (b *builder) addAnnotations() {
+	for _, name := range b.sortedServiceNames() {
+		svc := b.bd.Services[name]
+		if len(svc.Annotations) == 0 {
+			continue
+		}
+		id := b.serviceIds[name]
+		if id == name {
+			// The service already exists; leave its annotations
+			// alone rather than guessing whether they should be
+			// overwritten.
+			continue
+		}
+		b.add(&SetAnnotationsChange{
+			changeInfo:  changeInfo{id: b.newId("setAnnotations"), requires: []string{id}},
+			Target:      id,
+			EntityType:  "service",
+			Annotations: svc.Annotations,
+		})
+	}
+	for _, mid := range b.sortedMachineIds() {
+		spec := b.bd.Machines[mid]
+		if spec == nil || len(spec.Annotations) == 0 {
+			continue
+		}
+		id := b.machineIds[mid]
+		if id == mid {
+			continue
+		}
+		b.add(&SetAnnotationsChange{
+			changeInfo:  changeInfo{id: b.newId("setAnnotations"), requires: []string{id}},
+			Target:      id,
+			EntityType:  "machine",
+			Annotations: spec.Annotations,
+		})
+	}
+}
+
+// addExposed adds an ExposeChange for every service the bundle marks
+// as exposed that is not already known to be exposed in the model.
+func (b *builder) addExposed() {
+	for _, name := range b.sortedServiceNames() {
+		svc := b.bd.Services[name]
+		if !svc.Expose {
+			continue
+		}
+		if existing := b.existing.service(name); existing != nil && existing.Exposed {
+			continue
+		}
+		serviceId := b.serviceIds[name]
+		serviceIsChange := serviceId != name
+		var requires []string
+		if serviceIsChange {
+			requires = []string{serviceId}
+		}
+		b.add(&ExposeChange{
+			changeInfo:      changeInfo{id: b.newId("expose"), requires: requires},
+			Service:         name,
+			serviceIsChange: serviceIsChange,
+		})
+	}
+}
+
+// addOptionsAndConstraints adds SetOptionsChange and
+// SetConstraintsChange entries for services that already exist in
+// the model but whose bundle-declared options or constraints differ
+// from what is currently deployed.
+func (b *builder) addOptionsAndConstraints() {
+	for _, name := range b.sortedServiceNames() {
+		svc := b.bd.Services[name]
+		existing := b.existing.service(name)
+		if existing == nil {
+			// Options and constraints for newly-created services
+			// are already included in their AddServiceChange.
+			continue
+		}
+		if len(svc.Options) > 0 && !optionsEqual(svc.Options, existing.Options) {
+			b.add(&SetOptionsChange{
+				changeInfo: changeInfo{id: b.newId("setOptions")},
+				Service:    name,
+				Options:    svc.Options,
+			})
+		}
+		if svc.Constraints != "" && svc.Constraints != existing.Constraints {
+			b.add(&SetConstraintsChange{
+				changeInfo:  changeInfo{id: b.newId("setConstraints")},
+				Service:     name,
+				Constraints: svc.Constraints,
+			})
+		}
+	}
+}
+
+func optionsEqual(a, b map[string]interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
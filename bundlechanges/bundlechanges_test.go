@@ -0,0 +1,228 @@
+package bundlechanges_test
+
+import (
+	"strings"
+	"testing"
+
+	jujutesting "github.com/juju/testing"
+	"gopkg.in/juju/charm.v2"
+	"gopkg.in/juju/charm.v2/bundlechanges"
+	gc "launchpad.net/gocheck"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type bundleChangesSuite struct {
+	jujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&bundleChangesSuite{})
+
+func parseBundle(c *gc.C, s string) *charm.BundleData {
+	bd, err := charm.ReadBundleData(strings.NewReader(s))
+	c.Assert(err, gc.IsNil)
+	return bd
+}
+
+const wordpressBundle = `
+series: precise
+services:
+    wordpress:
+        charm: "cs:precise/wordpress-10"
+        num_units: 1
+    mysql:
+        charm: "cs:precise/mysql-28"
+        num_units: 1
+        to: ["new"]
+relations:
+    - ["wordpress:db", "mysql:db"]
+`
+
+func (s *bundleChangesSuite) TestFromDataNewDeployment(c *gc.C) {
+	bd := parseBundle(c, wordpressBundle)
+	changes, err := bundlechanges.FromData(bd, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(bundlechanges.Verify(changes), gc.IsNil)
+
+	counts := make(map[string]int)
+	for _, ch := range changes {
+		counts[ch.Method()]++
+	}
+	c.Assert(counts["addCharm"], gc.Equals, 2)
+	c.Assert(counts["deploy"], gc.Equals, 2)
+	c.Assert(counts["addUnit"], gc.Equals, 2)
+	c.Assert(counts["addMachines"], gc.Equals, 2)
+	c.Assert(counts["addRelation"], gc.Equals, 1)
+
+	// Every change must appear after everything it requires.
+	seen := make(map[string]bool)
+	for _, ch := range changes {
+		for _, req := range ch.Requires() {
+			c.Assert(seen[req], gc.Equals, true, gc.Commentf("change %q used before %q was created", ch.Id(), req))
+		}
+		seen[ch.Id()] = true
+	}
+}
+
+func (s *bundleChangesSuite) TestFromDataDedupesCharms(c *gc.C) {
+	bd := parseBundle(c, `
+services:
+    wordpress:
+        charm: "cs:precise/wordpress-10"
+        num_units: 1
+        to: ["new"]
+    wordpress2:
+        charm: "cs:precise/wordpress-10"
+        num_units: 1
+        to: ["new"]
+`)
+	changes, err := bundlechanges.FromData(bd, nil)
+	c.Assert(err, gc.IsNil)
+	n := 0
+	for _, ch := range changes {
+		if ch.Method() == "addCharm" {
+			n++
+		}
+	}
+	c.Assert(n, gc.Equals, 1)
+}
+
+func (s *bundleChangesSuite) TestFromDataReusesExistingService(c *gc.C) {
+	bd := parseBundle(c, wordpressBundle)
+	existing := &bundlechanges.Model{
+		Services: map[string]*bundlechanges.Service{
+			"mysql": {
+				Charm: "cs:precise/mysql-28",
+				Units: map[string]*bundlechanges.Unit{
+					"mysql/0": {Machine: "0"},
+				},
+			},
+		},
+	}
+	changes, err := bundlechanges.FromData(bd, existing)
+	c.Assert(err, gc.IsNil)
+	c.Assert(bundlechanges.Verify(changes), gc.IsNil)
+
+	for _, ch := range changes {
+		c.Assert(ch.Method(), gc.Not(gc.Equals), "")
+		if svc, ok := ch.(*bundlechanges.AddServiceChange); ok {
+			c.Assert(svc.Service, gc.Equals, "wordpress")
+		}
+		// mysql already has a unit, so only wordpress needs one.
+		if unit, ok := ch.(*bundlechanges.AddUnitChange); ok {
+			c.Assert(unit.Service, gc.Not(gc.Equals), "mysql")
+		}
+	}
+}
+
+func (s *bundleChangesSuite) TestFromDataColocatedPlacement(c *gc.C) {
+	bd := parseBundle(c, `
+services:
+    mysql:
+        charm: "cs:precise/mysql-28"
+        num_units: 1
+    wordpress:
+        charm: "cs:precise/wordpress-10"
+        num_units: 1
+        to: ["mysql/0"]
+`)
+	changes, err := bundlechanges.FromData(bd, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(bundlechanges.Verify(changes), gc.IsNil)
+
+	var mysqlUnitId string
+	var wordpressTo string
+	for _, ch := range changes {
+		unit, ok := ch.(*bundlechanges.AddUnitChange)
+		if !ok {
+			continue
+		}
+		if unit.Service == "mysql" {
+			mysqlUnitId = unit.Id()
+		} else {
+			wordpressTo = unit.To
+		}
+	}
+	c.Assert(mysqlUnitId, gc.Not(gc.Equals), "")
+	c.Assert(wordpressTo, gc.Equals, mysqlUnitId)
+
+	// Colocation must not create a machine for wordpress.
+	c.Assert(len(machineChanges(changes)), gc.Equals, 1)
+}
+
+func machineChanges(changes []bundlechanges.Change) []bundlechanges.Change {
+	var result []bundlechanges.Change
+	for _, ch := range changes {
+		if ch.Method() == "addMachines" {
+			result = append(result, ch)
+		}
+	}
+	return result
+}
+
+func (s *bundleChangesSuite) TestFromDataNewContainerPlacement(c *gc.C) {
+	bd := parseBundle(c, `
+services:
+    mysql:
+        charm: "cs:precise/mysql-28"
+        num_units: 1
+        to: ["lxc:new"]
+`)
+	changes, err := bundlechanges.FromData(bd, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(bundlechanges.Verify(changes), gc.IsNil)
+
+	// The container must have its own host machine, not just be
+	// floating with no parent.
+	machines := machineChanges(changes)
+	c.Assert(machines, gc.HasLen, 2)
+	var host, container *bundlechanges.AddMachineChange
+	for _, ch := range machines {
+		m := ch.(*bundlechanges.AddMachineChange)
+		if m.ContainerType == "" {
+			host = m
+		} else {
+			container = m
+		}
+	}
+	c.Assert(host, gc.NotNil)
+	c.Assert(container, gc.NotNil)
+	c.Assert(container.ParentId, gc.Equals, host.Id())
+}
+
+func (s *bundleChangesSuite) TestFromDataExistingMachineContainerPlacement(c *gc.C) {
+	bd := parseBundle(c, `
+machines:
+    "0": {}
+services:
+    mysql:
+        charm: "cs:precise/mysql-28"
+        num_units: 1
+        to: ["lxc:0"]
+`)
+	existing := &bundlechanges.Model{
+		Machines: map[string]*bundlechanges.Machine{
+			"0": {Id: "0"},
+		},
+	}
+	changes, err := bundlechanges.FromData(bd, existing)
+	c.Assert(err, gc.IsNil)
+	c.Assert(bundlechanges.Verify(changes), gc.IsNil)
+
+	machines := machineChanges(changes)
+	c.Assert(machines, gc.HasLen, 1)
+	container := machines[0].(*bundlechanges.AddMachineChange)
+	c.Assert(container.ParentId, gc.Equals, "0")
+	c.Assert(container.Args()["parentId"], gc.Equals, "0")
+}
+
+func (s *bundleChangesSuite) TestFromDataInvalidBundle(c *gc.C) {
+	bd := parseBundle(c, `
+services:
+    mysql:
+        charm: "bad charm url"
+        num_units: 1
+`)
+	_, err := bundlechanges.FromData(bd, nil)
+	c.Assert(err, gc.ErrorMatches, "cannot build changes for invalid bundle:.*")
+}
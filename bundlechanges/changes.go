@@ -0,0 +1,341 @@
+package bundlechanges
+
+// Change describes a single change needed to reconcile a model with
+// a bundle. Changes are returned in an order that respects the
+// dependencies reported by Requires: a change never appears before
+// the changes it requires.
+type Change interface {
+	// Id returns a string that uniquely identifies the change
+	// within the change set returned by FromData.
+	Id() string
+
+	// Requires returns the ids of the changes that must be applied
+	// before this one.
+	Requires() []string
+
+	// Method returns the name of the RPC call that applies the
+	// change (for example "addMachines" or "deploy").
+	Method() string
+
+	// Args returns the arguments to the RPC call in a form
+	// suitable for marshalling, mirroring the shape produced by
+	// GetChangesMapArgs in the Juju API. Any value that refers to
+	// another change is represented as "$" followed by that
+	// change's id, so that a client can substitute in the result
+	// of the prerequisite change once it has been applied.
+	Args() map[string]interface{}
+}
+
+// changeInfo holds the fields common to every kind of change, and
+// provides the Id and Requires methods.
+type changeInfo struct {
+	id       string
+	requires []string
+}
+
+func (c *changeInfo) Id() string {
+	return c.id
+}
+
+func (c *changeInfo) Requires() []string {
+	if c.requires == nil {
+		return []string{}
+	}
+	return c.requires
+}
+
+// AddCharmChange holds a change for adding a charm to the model.
+type AddCharmChange struct {
+	changeInfo
+
+	// CharmURL holds the URL of the charm to add.
+	CharmURL string
+}
+
+func (c *AddCharmChange) Method() string {
+	return "addCharm"
+}
+
+func (c *AddCharmChange) Args() map[string]interface{} {
+	return map[string]interface{}{
+		"charm": c.CharmURL,
+	}
+}
+
+// AddMachineChange holds a change for adding a machine or container.
+type AddMachineChange struct {
+	changeInfo
+
+	// Series holds the machine's series.
+	Series string
+
+	// Base holds the machine's base, if specified with the
+	// base-oriented bundle syntax rather than a series.
+	Base string
+
+	// Constraints holds the machine's constraints.
+	Constraints string
+
+	// ContainerType holds the type of container to create (for
+	// example "lxc"), or the empty string if the machine is not a
+	// container.
+	ContainerType string
+
+	// ParentId holds the id of the change (or existing machine id)
+	// that will host the container. It is empty unless
+	// ContainerType is set.
+	ParentId string
+
+	// parentIsChange reports whether ParentId refers to the id of a
+	// change, rather than an existing machine id. It is meaningless
+	// when ParentId is empty.
+	parentIsChange bool
+}
+
+func (c *AddMachineChange) Method() string {
+	return "addMachines"
+}
+
+func (c *AddMachineChange) Args() map[string]interface{} {
+	args := map[string]interface{}{}
+	if c.Series != "" {
+		args["series"] = c.Series
+	}
+	if c.Base != "" {
+		args["base"] = c.Base
+	}
+	if c.Constraints != "" {
+		args["constraints"] = c.Constraints
+	}
+	if c.ContainerType != "" {
+		args["containerType"] = c.ContainerType
+	}
+	if c.ParentId != "" {
+		args["parentId"] = ref(c.ParentId, c.parentIsChange)
+	}
+	return args
+}
+
+// AddServiceChange holds a change for deploying a service.
+type AddServiceChange struct {
+	changeInfo
+
+	// Charm holds the id of the AddCharmChange that adds the
+	// charm this service will use.
+	Charm string
+
+	// Service holds the name of the service to create.
+	Service string
+
+	// Series holds the series to deploy the service to.
+	Series string
+
+	// Options holds the configuration options to apply.
+	Options map[string]interface{}
+
+	// Constraints holds the constraints to apply to the service's
+	// machines.
+	Constraints string
+}
+
+func (c *AddServiceChange) Method() string {
+	return "deploy"
+}
+
+func (c *AddServiceChange) Args() map[string]interface{} {
+	args := map[string]interface{}{
+		"charm":   "$" + c.Charm,
+		"service": c.Service,
+	}
+	if c.Series != "" {
+		args["series"] = c.Series
+	}
+	if len(c.Options) > 0 {
+		args["options"] = c.Options
+	}
+	if c.Constraints != "" {
+		args["constraints"] = c.Constraints
+	}
+	return args
+}
+
+// AddUnitChange holds a change for adding a unit of a service.
+type AddUnitChange struct {
+	changeInfo
+
+	// Service holds the name of the service the unit belongs to.
+	Service string
+
+	// serviceIsChange reports whether the service is deployed by an
+	// AddServiceChange in the same change set, rather than already
+	// existing in the model. The id of that change is then the first
+	// element of Requires.
+	serviceIsChange bool
+
+	// To holds the placement for the unit: either the id of a
+	// change that creates the hosting machine or co-located unit,
+	// or an existing machine id. FromData always sets it: a unit
+	// with no placement directive gets a change that creates a new
+	// machine for it.
+	To string
+
+	// toIsChange reports whether To refers to the id of a change,
+	// rather than an existing machine id. It is meaningless when To
+	// is empty.
+	toIsChange bool
+}
+
+func (c *AddUnitChange) Method() string {
+	return "addUnit"
+}
+
+func (c *AddUnitChange) Args() map[string]interface{} {
+	service := c.Service
+	if c.serviceIsChange {
+		service = ref(c.requires[0], true)
+	}
+	args := map[string]interface{}{
+		"service": service,
+	}
+	if c.To != "" {
+		args["to"] = ref(c.To, c.toIsChange)
+	}
+	return args
+}
+
+// ref renders a value that may refer either to the id of a change
+// still to be applied (in which case it must be prefixed with "$" so
+// that a client can substitute in the result of that change once
+// applied) or to the name or id of an entity that already exists in
+// the model (in which case it is used as is).
+func ref(value string, isChange bool) string {
+	if isChange {
+		return "$" + value
+	}
+	return value
+}
+
+// AddRelationChange holds a change for adding a relation between
+// two services.
+type AddRelationChange struct {
+	changeInfo
+
+	// Endpoint1 and Endpoint2 hold the two relation endpoints, in
+	// "service:relation" form, exactly as found in the bundle.
+	Endpoint1 string
+	Endpoint2 string
+}
+
+func (c *AddRelationChange) Method() string {
+	return "addRelation"
+}
+
+func (c *AddRelationChange) Args() map[string]interface{} {
+	return map[string]interface{}{
+		"endpoint1": c.Endpoint1,
+		"endpoint2": c.Endpoint2,
+	}
+}
+
+// SetAnnotationsChange holds a change for setting annotations on a
+// service or machine.
+type SetAnnotationsChange struct {
+	changeInfo
+
+	// Target holds the id of the change that creates the entity
+	// being annotated.
+	Target string
+
+	// EntityType holds the type of entity being annotated, either
+	// "service" or "machine".
+	EntityType string
+
+	// Annotations holds the annotations to set.
+	Annotations map[string]string
+}
+
+func (c *SetAnnotationsChange) Method() string {
+	return "setAnnotations"
+}
+
+func (c *SetAnnotationsChange) Args() map[string]interface{} {
+	return map[string]interface{}{
+		"id":          "$" + c.Target,
+		"entityType":  c.EntityType,
+		"annotations": c.Annotations,
+	}
+}
+
+// ExposeChange holds a change for exposing a service.
+type ExposeChange struct {
+	changeInfo
+
+	// Service holds the name of the service to expose.
+	Service string
+
+	// serviceIsChange reports whether the service is deployed by an
+	// AddServiceChange in the same change set, rather than already
+	// existing in the model. The id of that change is then the only
+	// element of Requires.
+	serviceIsChange bool
+}
+
+func (c *ExposeChange) Method() string {
+	return "expose"
+}
+
+func (c *ExposeChange) Args() map[string]interface{} {
+	service := c.Service
+	if c.serviceIsChange {
+		service = ref(c.requires[0], true)
+	}
+	return map[string]interface{}{
+		"service": service,
+	}
+}
+
+// SetOptionsChange holds a change for updating the configuration
+// options of an already-deployed service.
+type SetOptionsChange struct {
+	changeInfo
+
+	// Service holds the name of the already-deployed service.
+	Service string
+
+	// Options holds the new option values to set.
+	Options map[string]interface{}
+}
+
+func (c *SetOptionsChange) Method() string {
+	return "setOptions"
+}
+
+func (c *SetOptionsChange) Args() map[string]interface{} {
+	return map[string]interface{}{
+		"service": c.Service,
+		"options": c.Options,
+	}
+}
+
+// SetConstraintsChange holds a change for updating the constraints
+// of an already-deployed service.
+type SetConstraintsChange struct {
+	changeInfo
+
+	// Service holds the name of the already-deployed service.
+	Service string
+
+	// Constraints holds the new constraints to set.
+	Constraints string
+}
+
+func (c *SetConstraintsChange) Method() string {
+	return "setConstraints"
+}
+
+func (c *SetConstraintsChange) Args() map[string]interface{} {
+	return map[string]interface{}{
+		"service":     c.Service,
+		"constraints": c.Constraints,
+	}
+}
@@ -0,0 +1,63 @@
+package bundlechanges
+
+// Model describes the relevant parts of an already-deployed
+// environment, so that FromData can avoid proposing changes for
+// entities that already exist.
+type Model struct {
+	// Services holds the services already present in the model,
+	// indexed by service name.
+	Services map[string]*Service
+
+	// Machines holds the ids of the machines already present in
+	// the model, indexed by machine id.
+	Machines map[string]*Machine
+}
+
+// Service describes an already-deployed service.
+type Service struct {
+	// Charm holds the charm URL the service is currently using.
+	Charm string
+
+	// Options holds the currently configured option values.
+	Options map[string]interface{}
+
+	// Constraints holds the currently configured constraints.
+	Constraints string
+
+	// Exposed holds whether the service is currently exposed.
+	Exposed bool
+
+	// Units holds the units of the service, indexed by unit name
+	// (for example "mysql/0").
+	Units map[string]*Unit
+}
+
+// Unit describes an already-deployed unit.
+type Unit struct {
+	// Machine holds the id of the machine the unit is assigned to.
+	Machine string
+}
+
+// Machine describes an already-existing machine.
+type Machine struct {
+	// Id holds the machine id.
+	Id string
+}
+
+// service returns the named service from the model, or nil if the
+// model is nil or the service is not present.
+func (m *Model) service(name string) *Service {
+	if m == nil {
+		return nil
+	}
+	return m.Services[name]
+}
+
+// machine returns the named machine from the model, or nil if the
+// model is nil or the machine is not present.
+func (m *Model) machine(id string) *Machine {
+	if m == nil {
+		return nil
+	}
+	return m.Machines[id]
+}
@@ -0,0 +1,46 @@
+package bundlechanges
+
+import "fmt"
+
+// VerificationError holds a set of errors found while verifying a
+// computed change set.
+type VerificationError struct {
+	Errors []error
+}
+
+func (err *VerificationError) Error() string {
+	switch len(err.Errors) {
+	case 0:
+		return "no verification errors!"
+	case 1:
+		return err.Errors[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more)", err.Errors[0], len(err.Errors)-1)
+}
+
+// Verify checks a change set produced by FromData for internal
+// consistency, collecting every problem it finds rather than
+// stopping at the first one, so that a caller can present the whole
+// plan together with any warnings about it.
+func Verify(changes []Change) error {
+	ids := make(map[string]bool, len(changes))
+	var errs []error
+	for _, c := range changes {
+		if ids[c.Id()] {
+			errs = append(errs, fmt.Errorf("duplicate change id %q", c.Id()))
+			continue
+		}
+		ids[c.Id()] = true
+	}
+	for _, c := range changes {
+		for _, req := range c.Requires() {
+			if !ids[req] {
+				errs = append(errs, fmt.Errorf("change %q requires unknown change %q", c.Id(), req))
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return &VerificationError{errs}
+}
@@ -0,0 +1,541 @@
+package charm
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"launchpad.net/goyaml"
+)
+
+// BundleData holds the contents of a bundle.
+type BundleData struct {
+	// Series holds the default series to use when
+	// the bundle chooses not to specify a base or series
+	// for a service or machine.
+	Series string `yaml:"series,omitempty"`
+
+	// DefaultBase holds the default base to use when
+	// the bundle chooses not to specify a base or series
+	// for a service or machine. It is the base-oriented
+	// equivalent of Series, using the "os@channel" form
+	// (for example "ubuntu@22.04").
+	DefaultBase string `yaml:"default-base,omitempty"`
+
+	// Machines holds the machines referred to by unit
+	// placements, indexed by machine id. Verify reports
+	// a placement that refers to a machine not held here,
+	// and a machine held here that no placement refers to.
+	Machines map[string]*MachineSpec `yaml:"machines,omitempty"`
+
+	// Services holds one entry for each service
+	// that the bundle will create, indexed by
+	// the service name.
+	Services map[string]*ServiceSpec `yaml:"services"`
+
+	// Relations holds a slice of 2-element slices,
+	// each specifying a relation between two services.
+	// Each element of the is a string of the form
+	// "service:relation".
+	Relations [][]string `yaml:"relations,omitempty"`
+}
+
+// ServiceSpec holds the options for a particular
+// service that will be created as part of the bundle.
+type ServiceSpec struct {
+	// Charm holds the charm URL of the charm to
+	// use for the given service.
+	Charm string `yaml:"charm"`
+
+	// Series holds the series to use when deploying the
+	// service, overriding the bundle-level series.
+	Series string `yaml:"series,omitempty"`
+
+	// Base holds the base to use when deploying the
+	// service, overriding the bundle-level default base.
+	// It is the base-oriented equivalent of Series.
+	Base string `yaml:"base,omitempty"`
+
+	// NumUnits holds the number of units of the
+	// service that will be deployed.
+	NumUnits int `yaml:"num_units"`
+
+	// To holds a list of placement directives, one for
+	// each unit of the service, as parsed by ParsePlacement.
+	// If there are less elements in To than NumUnits,
+	// the last element is used for all remaining units.
+	To []string `yaml:"to,omitempty"`
+
+	// Options holds the configuration values
+	// to apply to the new service.
+	Options map[string]interface{} `yaml:"options,omitempty"`
+
+	// Annotations holds any annotations to apply
+	// to the service when deployed.
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+
+	// Constraints holds the default constraints
+	// to apply when creating the service's machines.
+	Constraints string `yaml:"constraints,omitempty"`
+
+	// Expose holds whether the service is exposed once deployed.
+	Expose bool `yaml:"expose,omitempty"`
+
+	// Storage holds the storage constraints for the service,
+	// indexed by storage name, as parsed by
+	// ParseStorageConstraints.
+	Storage map[string]string `yaml:"storage,omitempty"`
+
+	// Devices holds the device constraints for the service,
+	// indexed by device name, as parsed by ParseDeviceConstraints.
+	Devices map[string]string `yaml:"devices,omitempty"`
+}
+
+// MachineSpec holds the specification for a new machine
+// that will be added as part of the bundle deployment.
+type MachineSpec struct {
+	// Series holds the series of the machine, overriding
+	// the bundle-level series.
+	Series string `yaml:"series,omitempty"`
+
+	// Base holds the base of the machine, overriding the
+	// bundle-level default base. It is the base-oriented
+	// equivalent of Series.
+	Base string `yaml:"base,omitempty"`
+
+	// Constraints holds the machine constraints.
+	Constraints string `yaml:"constraints,omitempty"`
+
+	// Annotations holds any annotations to apply to the
+	// machine when created.
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// ReadBundleData parses the data in the given reader as bundle YAML.
+func ReadBundleData(r io.Reader) (*BundleData, error) {
+	bytes, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read bundle data: %v", err)
+	}
+	var bd BundleData
+	if err := goyaml.Unmarshal(bytes, &bd); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal bundle data: %v", err)
+	}
+	return &bd, nil
+}
+
+// VerificationError holds a set of errors generated while verifying a
+// bundle.
+type VerificationError struct {
+	Errors []error
+}
+
+func (err *VerificationError) Error() string {
+	switch len(err.Errors) {
+	case 0:
+		return "no verification errors!"
+	case 1:
+		return err.Errors[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more)", err.Errors[0], len(err.Errors)-1)
+}
+
+var validSeries = regexp.MustCompile(`^[a-z][a-z0-9]*$`)
+var validMachineId = regexp.MustCompile(`^(0|[1-9][0-9]*)$`)
+
+// Verify is used to check for errors in a bundle's data. The
+// verifyConstraints function is called to verify any constraints
+// that are found, verifyStorage is called to verify any storage
+// constraints, and verifyDevices is called to verify any device
+// constraints. If any of these is nil, no additional checking beyond
+// parsing is done for the corresponding kind of constraint.
+func (bd *BundleData) Verify(
+	verifyConstraints func(c string) error,
+	verifyStorage func(c string) error,
+	verifyDevices func(c string) error,
+) error {
+	return bd.verify(verifyConstraints, verifyStorage, verifyDevices, false)
+}
+
+// verifyWellFormed checks bd for the subset of Verify's checks that
+// depend only on bd itself, skipping the checks that require every
+// machine or service referred to by a placement or relation to be
+// declared in bd, and the check that every machine declared in bd is
+// referred to by a placement. It is used by DiffBundle, which compares bd against
+// a live model where such machines and services may legitimately
+// already exist without being redeclared.
+func (bd *BundleData) verifyWellFormed() error {
+	return bd.verify(nil, nil, nil, true)
+}
+
+func (bd *BundleData) verify(
+	verifyConstraints func(c string) error,
+	verifyStorage func(c string) error,
+	verifyDevices func(c string) error,
+	allowUndeclaredEntities bool,
+) error {
+	v := &bdVerifier{
+		bd:                      bd,
+		verifyConstraints:       verifyConstraints,
+		verifyStorage:           verifyStorage,
+		verifyDevices:           verifyDevices,
+		allowUndeclaredEntities: allowUndeclaredEntities,
+	}
+	v.verifyBundleBase()
+	v.verifyMachines()
+	v.verifyServices()
+	v.verifyRelations()
+	v.verifyPlacements()
+	v.verifyNoUnresolvedVariables()
+	if len(v.errors) == 0 {
+		return nil
+	}
+	return &VerificationError{v.errors}
+}
+
+// bdVerifier holds the state used while verifying a BundleData.
+type bdVerifier struct {
+	bd                *BundleData
+	verifyConstraints func(c string) error
+	verifyStorage     func(c string) error
+	verifyDevices     func(c string) error
+	errors            []error
+
+	// allowUndeclaredEntities suppresses the checks that require
+	// every machine or service referred to by a placement or
+	// relation to be declared in bd, and the check that every
+	// machine declared in bd is referred to by a placement, for use
+	// when bd is being compared against a live model rather than
+	// verified for deployment.
+	allowUndeclaredEntities bool
+
+	// placedMachines holds the set of machine ids referred to
+	// by a placement directive.
+	placedMachines map[string]bool
+}
+
+func (v *bdVerifier) addErrorf(f string, a ...interface{}) {
+	v.errors = append(v.errors, fmt.Errorf(f, a...))
+}
+
+// entitySeries resolves the series implied by an optional series
+// string and an optional base string, checking that they are
+// consistent with each other.
+func (v *bdVerifier) entitySeries(kind, name, series, base string) {
+	if base == "" {
+		return
+	}
+	b, err := ParseBase(base)
+	if err != nil {
+		v.addErrorf("invalid base %q in %s %q: %v", base, kind, name, err)
+		return
+	}
+	baseSeries, err := b.Series()
+	if err != nil {
+		v.addErrorf("invalid base %q in %s %q: %v", base, kind, name, err)
+		return
+	}
+	if series != "" && series != baseSeries {
+		v.addErrorf("%s %q specifies series %q and base %q which resolve to different releases", kind, name, series, base)
+	}
+}
+
+func (v *bdVerifier) verifyBundleBase() {
+	if v.bd.Series != "" && !validSeries.MatchString(v.bd.Series) {
+		v.addErrorf("bundle declares an invalid series %q", v.bd.Series)
+	}
+	if v.bd.DefaultBase == "" {
+		return
+	}
+	b, err := ParseBase(v.bd.DefaultBase)
+	if err != nil {
+		v.addErrorf("invalid default base %q in bundle: %v", v.bd.DefaultBase, err)
+		return
+	}
+	if v.bd.Series == "" {
+		return
+	}
+	baseSeries, err := b.Series()
+	if err != nil {
+		v.addErrorf("invalid default base %q in bundle: %v", v.bd.DefaultBase, err)
+		return
+	}
+	if baseSeries != v.bd.Series {
+		v.addErrorf("bundle specifies series %q and default base %q which resolve to different releases", v.bd.Series, v.bd.DefaultBase)
+	}
+}
+
+func (v *bdVerifier) verifyMachines() {
+	for id, m := range v.bd.Machines {
+		if !validMachineId.MatchString(id) {
+			v.addErrorf("invalid machine id %q found in machines", id)
+		}
+		if m == nil {
+			continue
+		}
+		v.entitySeries("machine", id, m.Series, m.Base)
+		if m.Constraints != "" && v.verifyConstraints != nil {
+			if err := v.verifyConstraints(m.Constraints); err != nil {
+				v.addErrorf("invalid constraints %q in machine %q: %v", m.Constraints, id, err)
+			}
+		}
+	}
+}
+
+func (v *bdVerifier) verifyServices() {
+	for name, svc := range v.bd.Services {
+		if svc == nil {
+			continue
+		}
+		if _, err := ParseURL(svc.Charm); err != nil {
+			v.addErrorf("invalid charm URL in service %q: %v", name, err)
+		}
+		v.entitySeries("service", name, svc.Series, svc.Base)
+		if svc.Constraints != "" && v.verifyConstraints != nil {
+			if err := v.verifyConstraints(svc.Constraints); err != nil {
+				v.addErrorf("invalid constraints %q in service %q: %v", svc.Constraints, name, err)
+			}
+		}
+		if svc.NumUnits < 0 {
+			v.addErrorf("negative number of units specified on service %q", name)
+		}
+		if svc.NumUnits >= 0 && len(svc.To) > svc.NumUnits {
+			v.addErrorf("too many units specified in unit placement for service %q", name)
+		}
+		v.verifyServiceStorage(name, svc)
+		v.verifyServiceDevices(name, svc)
+	}
+}
+
+// verifyServiceStorage checks that every storage constraint declared
+// by svc is syntactically valid, additionally calling
+// v.verifyStorage on each one if it is set.
+func (v *bdVerifier) verifyServiceStorage(name string, svc *ServiceSpec) {
+	for storageName, cons := range svc.Storage {
+		if _, err := ParseStorageConstraints(cons); err != nil {
+			v.addErrorf("invalid storage %q in service %q: %v", storageName, name, err)
+			continue
+		}
+		if v.verifyStorage != nil {
+			if err := v.verifyStorage(cons); err != nil {
+				v.addErrorf("invalid storage %q in service %q: %v", storageName, name, err)
+			}
+		}
+	}
+}
+
+// verifyServiceDevices checks that every device constraint declared
+// by svc is syntactically valid, additionally calling
+// v.verifyDevices on each one if it is set.
+func (v *bdVerifier) verifyServiceDevices(name string, svc *ServiceSpec) {
+	for deviceName, cons := range svc.Devices {
+		if _, err := ParseDeviceConstraints(cons); err != nil {
+			v.addErrorf("invalid device %q in service %q: %v", deviceName, name, err)
+			continue
+		}
+		if v.verifyDevices != nil {
+			if err := v.verifyDevices(cons); err != nil {
+				v.addErrorf("invalid device %q in service %q: %v", deviceName, name, err)
+			}
+		}
+	}
+}
+
+func (v *bdVerifier) verifyPlacements() {
+	v.placedMachines = make(map[string]bool)
+	for _, svc := range v.bd.Services {
+		if svc == nil {
+			continue
+		}
+		for _, p := range svc.To {
+			up, err := ParsePlacement(p)
+			if err != nil {
+				v.addErrorf("invalid placement syntax %q", p)
+				continue
+			}
+			if up.Machine != "" {
+				if up.Machine != "new" {
+					v.placedMachines[up.Machine] = true
+					if v.bd.Machines[up.Machine] == nil && !v.allowUndeclaredEntities {
+						v.addErrorf("placement %q refers to a machine not defined in this bundle", p)
+					}
+				}
+				continue
+			}
+			target, ok := v.bd.Services[up.Service]
+			if !ok {
+				if !v.allowUndeclaredEntities {
+					v.addErrorf("placement %q refers to a service not defined in this bundle", p)
+				}
+				continue
+			}
+			if up.Unit != -1 && up.Unit >= target.NumUnits {
+				v.addErrorf("placement %q specifies a unit greater than the %d unit(s) started by the target service", p, target.NumUnits)
+			}
+		}
+	}
+	if v.allowUndeclaredEntities {
+		return
+	}
+	ids := make([]string, 0, len(v.bd.Machines))
+	for id := range v.bd.Machines {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if !v.placedMachines[id] {
+			v.addErrorf("machine %q is not referred to by a placement directive", id)
+		}
+	}
+}
+
+var unresolvedVariable = regexp.MustCompile(`\$\{[^}]*\}`)
+
+// verifyNoUnresolvedVariables checks that no "${...}" interpolation
+// token remains in a service's charm URL, constraints or option
+// values, which would indicate that the bundle was read without
+// first resolving its variables (see InterpolateBundle).
+func (v *bdVerifier) verifyNoUnresolvedVariables() {
+	for name, svc := range v.bd.Services {
+		if svc == nil {
+			continue
+		}
+		if unresolvedVariable.MatchString(svc.Charm) {
+			v.addErrorf("unresolved variable in charm URL of service %q: %q", name, svc.Charm)
+		}
+		if unresolvedVariable.MatchString(svc.Constraints) {
+			v.addErrorf("unresolved variable in constraints of service %q: %q", name, svc.Constraints)
+		}
+		for key, value := range svc.Options {
+			s, ok := value.(string)
+			if ok && unresolvedVariable.MatchString(s) {
+				v.addErrorf("unresolved variable in option %q of service %q: %q", key, name, s)
+			}
+		}
+	}
+}
+
+func (v *bdVerifier) verifyRelations() {
+	seen := make(map[string]bool)
+	for _, rel := range v.bd.Relations {
+		if len(rel) != 2 {
+			v.addErrorf("relation %q has %d endpoint(s), not 2", rel, len(rel))
+			continue
+		}
+		services := make([]string, len(rel))
+		invalid := false
+		for i, ep := range rel {
+			parts := strings.SplitN(ep, ":", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				v.addErrorf("invalid relation syntax %q", ep)
+				invalid = true
+				continue
+			}
+			services[i] = parts[0]
+		}
+		if invalid {
+			continue
+		}
+		if services[0] == services[1] {
+			v.addErrorf("relation %q relates a service to itself", rel)
+			continue
+		}
+		missing := false
+		for _, svc := range services {
+			if _, ok := v.bd.Services[svc]; !ok {
+				if !v.allowUndeclaredEntities {
+					v.addErrorf("relation %q refers to service %q not defined in this bundle", rel, svc)
+				}
+				missing = true
+			}
+		}
+		if missing && !v.allowUndeclaredEntities {
+			continue
+		}
+		key := rel[0] + " " + rel[1]
+		if rel[1] < rel[0] {
+			key = rel[1] + " " + rel[0]
+		}
+		if seen[key] {
+			v.addErrorf("relation %q is defined more than once", rel)
+			continue
+		}
+		seen[key] = true
+	}
+}
+
+// UnitPlacement represents the location of a unit as parsed
+// from a "to" placement directive in a service specification.
+type UnitPlacement struct {
+	// ContainerType holds the container type of the placement,
+	// or the empty string if the unit is not to be placed in a
+	// container.
+	ContainerType string
+
+	// Machine holds the machine id to place the unit in, or
+	// "new" if the unit should be placed in a new machine. It
+	// is empty if Service is set.
+	Machine string
+
+	// Service holds the name of the service whose unit the
+	// new unit should be placed alongside. It is empty if
+	// Machine is set.
+	Service string
+
+	// Unit holds the unit number of the service that the new
+	// unit should be placed alongside, or -1 if the placement
+	// applies to the service as a whole (meaning any of its
+	// units may be used).
+	Unit int
+}
+
+var (
+	validContainerType = regexp.MustCompile(`^[a-z]+$`)
+	validPlacementName = regexp.MustCompile(`^[a-z][a-z0-9]*(-[a-z0-9]+)*$`)
+)
+
+// ParsePlacement parses a unit placement directive, as used
+// in the "to" field of a service specification.
+func ParsePlacement(p string) (*UnitPlacement, error) {
+	up := &UnitPlacement{Unit: -1}
+	orig := p
+	if i := strings.Index(p, ":"); i != -1 {
+		container := p[:i]
+		if container == "" || !validContainerType.MatchString(container) {
+			return nil, fmt.Errorf("invalid placement syntax %q", orig)
+		}
+		up.ContainerType = container
+		p = p[i+1:]
+	}
+	if p == "" {
+		return nil, fmt.Errorf("invalid placement syntax %q", orig)
+	}
+	if p == "new" {
+		up.Machine = "new"
+		return up, nil
+	}
+	if validMachineId.MatchString(p) {
+		up.Machine = p
+		return up, nil
+	}
+	parts := strings.SplitN(p, "/", 2)
+	if parts[0] == "new" || !validPlacementName.MatchString(parts[0]) {
+		return nil, fmt.Errorf("invalid placement syntax %q", orig)
+	}
+	up.Service = parts[0]
+	if len(parts) == 2 {
+		if len(parts[1]) == 0 || (len(parts[1]) > 1 && parts[1][0] == '0') {
+			return nil, fmt.Errorf("invalid placement syntax %q", orig)
+		}
+		unit, err := strconv.Atoi(parts[1])
+		if err != nil || unit < 0 {
+			return nil, fmt.Errorf("invalid placement syntax %q", orig)
+		}
+		up.Unit = unit
+	}
+	return up, nil
+}
@@ -228,7 +228,7 @@ func (*bundleDataSuite) TestVerifyErrors(c *gc.C) {
 				return fmt.Errorf("bad constraint")
 			}
 			return nil
-		})
+		}, nil, nil)
 		if len(test.errors) == 0 {
 			c.Assert(err, gc.IsNil)
 			continue
@@ -258,7 +258,7 @@ func (*bundleDataSuite) TestVerifyCharmURL(c *gc.C) {
 		"local:foo-45",
 	} {
 		bd.Services["mediawiki"].Charm = u
-		err := bd.Verify(func(string) error { return nil })
+		err := bd.Verify(func(string) error { return nil }, nil, nil)
 		c.Assert(err, gc.IsNil, gc.Commentf("charm url %q", u))
 	}
 }
@@ -0,0 +1,611 @@
+package charm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"launchpad.net/goyaml"
+)
+
+// ModelSnapshot describes the services, units, machines and
+// relations currently deployed in a model, in enough detail for
+// DiffBundle to compare it against a bundle.
+type ModelSnapshot struct {
+	// Services holds the currently deployed services, indexed by
+	// service name.
+	Services map[string]*ServiceSnapshot
+
+	// Machines holds the currently existing machines, indexed by
+	// machine id.
+	Machines map[string]*MachineSnapshot
+
+	// Relations holds the currently established relations, in the
+	// same "service:relation" pair form as BundleData.Relations.
+	Relations [][]string
+}
+
+// ServiceSnapshot describes a single currently deployed service.
+type ServiceSnapshot struct {
+	// Charm holds the URL of the charm the service is currently
+	// running.
+	Charm string
+
+	// Options holds the service's current configuration values.
+	Options map[string]interface{}
+
+	// Constraints holds the service's current constraints.
+	Constraints string
+
+	// Annotations holds the service's current annotations.
+	Annotations map[string]string
+
+	// Exposed holds whether the service is currently exposed.
+	Exposed bool
+
+	// Units holds the service's current units, indexed by unit
+	// name (for example "mysql/0").
+	Units map[string]*UnitSnapshot
+}
+
+// UnitSnapshot describes a single currently deployed unit.
+type UnitSnapshot struct {
+	// Machine holds the id of the machine the unit is assigned to.
+	Machine string
+}
+
+// MachineSnapshot describes a single currently existing machine.
+type MachineSnapshot struct {
+	// Constraints holds the machine's current constraints.
+	Constraints string
+
+	// Annotations holds the machine's current annotations.
+	Annotations map[string]string
+}
+
+// BundleDiff is a structured report of the differences between a
+// bundle and a ModelSnapshot, as produced by DiffBundle.
+type BundleDiff struct {
+	// Services holds an entry for every service that the bundle
+	// would add, remove or change, indexed by service name.
+	Services map[string]*ServiceDiff `yaml:"services,omitempty" json:"services,omitempty"`
+
+	// Machines holds an entry for every machine that the bundle
+	// would add, remove or change, indexed by machine id.
+	Machines map[string]*MachineDiff `yaml:"machines,omitempty" json:"machines,omitempty"`
+
+	// Relations holds the relations that the bundle would add or
+	// remove, or nil if there are none.
+	Relations *RelationDiff `yaml:"relations,omitempty" json:"relations,omitempty"`
+}
+
+// ServiceDiff describes how a single service differs between a
+// bundle and a ModelSnapshot.
+type ServiceDiff struct {
+	// Added reports that the service is declared in the bundle but
+	// not currently deployed. No other field is populated in this
+	// case.
+	Added bool `yaml:"added,omitempty" json:"added,omitempty"`
+
+	// Removed reports that the service is currently deployed but
+	// not declared in the bundle. No other field is populated in
+	// this case.
+	Removed bool `yaml:"removed,omitempty" json:"removed,omitempty"`
+
+	// Charm reports a change of charm URL, or nil if the charm URL
+	// is unchanged.
+	Charm *CharmChange `yaml:"charm,omitempty" json:"charm,omitempty"`
+
+	// NumUnits reports a change in the number of units, or nil if
+	// it is unchanged.
+	NumUnits *UnitCountChange `yaml:"num_units,omitempty" json:"num_units,omitempty"`
+
+	// UnsatisfiedPlacements holds the placement directives from the
+	// bundle's "to" list that are not satisfied by any
+	// currently-deployed unit of the service, as determined by
+	// ParsePlacement. A directive of "new" is always considered
+	// unsatisfied, since it always implies a new unit.
+	UnsatisfiedPlacements []string `yaml:"unsatisfied_placements,omitempty" json:"unsatisfied_placements,omitempty"`
+
+	// Constraints reports a change of constraints, or nil if they
+	// are unchanged.
+	Constraints *StringChange `yaml:"constraints,omitempty" json:"constraints,omitempty"`
+
+	// Exposed reports that the bundle requires the service to be
+	// exposed but it is not currently exposed. DiffBundle never
+	// reports the opposite change, since a bundle that does not
+	// mention "expose: true" is not making a claim that the
+	// service should be unexposed.
+	Exposed *BoolChange `yaml:"exposed,omitempty" json:"exposed,omitempty"`
+
+	// Options holds the configuration options that the bundle
+	// declares with a value different from the one currently
+	// deployed, indexed by option name.
+	Options map[string]*OptionChange `yaml:"options,omitempty" json:"options,omitempty"`
+
+	// Annotations holds the annotations that the bundle declares
+	// with a value different from the one currently deployed,
+	// indexed by annotation name.
+	Annotations map[string]*StringChange `yaml:"annotations,omitempty" json:"annotations,omitempty"`
+}
+
+// MachineDiff describes how a single machine differs between a
+// bundle and a ModelSnapshot.
+type MachineDiff struct {
+	// Added reports that the machine is declared in the bundle but
+	// does not currently exist. No other field is populated in
+	// this case.
+	Added bool `yaml:"added,omitempty" json:"added,omitempty"`
+
+	// Removed reports that the machine currently exists but is not
+	// declared in the bundle. No other field is populated in this
+	// case.
+	Removed bool `yaml:"removed,omitempty" json:"removed,omitempty"`
+
+	// Constraints reports a change of constraints, or nil if they
+	// are unchanged.
+	Constraints *StringChange `yaml:"constraints,omitempty" json:"constraints,omitempty"`
+
+	// Annotations holds the annotations that the bundle declares
+	// with a value different from the one currently deployed,
+	// indexed by annotation name.
+	Annotations map[string]*StringChange `yaml:"annotations,omitempty" json:"annotations,omitempty"`
+}
+
+// RelationDiff describes the relations that a bundle would add or
+// remove relative to a ModelSnapshot.
+type RelationDiff struct {
+	// Added holds the relations declared by the bundle that are
+	// not currently established.
+	Added [][]string `yaml:"added,omitempty" json:"added,omitempty"`
+
+	// Removed holds the relations currently established that are
+	// not declared by the bundle.
+	Removed [][]string `yaml:"removed,omitempty" json:"removed,omitempty"`
+}
+
+// CharmChange describes a change of charm URL.
+type CharmChange struct {
+	Old string `yaml:"old" json:"old"`
+	New string `yaml:"new" json:"new"`
+
+	// Upgrade reports whether New has a higher revision than Old
+	// of what is otherwise the same charm URL.
+	Upgrade bool `yaml:"upgrade,omitempty" json:"upgrade,omitempty"`
+
+	// Downgrade reports whether New has a lower revision than Old
+	// of what is otherwise the same charm URL.
+	Downgrade bool `yaml:"downgrade,omitempty" json:"downgrade,omitempty"`
+}
+
+// UnitCountChange describes a change in the number of units.
+type UnitCountChange struct {
+	Old int `yaml:"old" json:"old"`
+	New int `yaml:"new" json:"new"`
+}
+
+// StringChange describes a change of a single string value.
+type StringChange struct {
+	Old string `yaml:"old" json:"old"`
+	New string `yaml:"new" json:"new"`
+}
+
+// BoolChange describes a change of a single boolean value.
+type BoolChange struct {
+	Old bool `yaml:"old" json:"old"`
+	New bool `yaml:"new" json:"new"`
+}
+
+// OptionChange describes a change of a single configuration option
+// value. Old is nil when the bundle introduces a value
+// for a key that was not previously set.
+type OptionChange struct {
+	Old interface{} `yaml:"old" json:"old"`
+	New interface{} `yaml:"new" json:"new"`
+}
+
+// Empty reports whether d describes no differences at all.
+func (d *BundleDiff) Empty() bool {
+	if d == nil {
+		return true
+	}
+	if len(d.Services) > 0 || len(d.Machines) > 0 {
+		return false
+	}
+	if d.Relations != nil && (len(d.Relations.Added) > 0 || len(d.Relations.Removed) > 0) {
+		return false
+	}
+	return true
+}
+
+// YAML renders d as YAML.
+func (d *BundleDiff) YAML() ([]byte, error) {
+	return goyaml.Marshal(d)
+}
+
+// JSON renders d as JSON, in a form stable across calls with
+// equivalent content.
+func (d *BundleDiff) JSON() ([]byte, error) {
+	return json.Marshal(d)
+}
+
+// String returns a human-readable summary of d.
+func (d *BundleDiff) String() string {
+	if d.Empty() {
+		return "no changes"
+	}
+	var buf bytes.Buffer
+	for _, name := range sortedServiceDiffNames(d.Services) {
+		sd := d.Services[name]
+		switch {
+		case sd.Added:
+			fmt.Fprintf(&buf, "+ service %s (new)\n", name)
+			continue
+		case sd.Removed:
+			fmt.Fprintf(&buf, "- service %s (removed)\n", name)
+			continue
+		}
+		fmt.Fprintf(&buf, "~ service %s\n", name)
+		if sd.Charm != nil {
+			note := ""
+			switch {
+			case sd.Charm.Upgrade:
+				note = " (upgrade)"
+			case sd.Charm.Downgrade:
+				note = " (downgrade)"
+			}
+			fmt.Fprintf(&buf, "    charm: %s -> %s%s\n", sd.Charm.Old, sd.Charm.New, note)
+		}
+		if sd.NumUnits != nil {
+			fmt.Fprintf(&buf, "    num_units: %d -> %d\n", sd.NumUnits.Old, sd.NumUnits.New)
+		}
+		for _, p := range sd.UnsatisfiedPlacements {
+			fmt.Fprintf(&buf, "    unsatisfied placement: %s\n", p)
+		}
+		if sd.Constraints != nil {
+			fmt.Fprintf(&buf, "    constraints: %q -> %q\n", sd.Constraints.Old, sd.Constraints.New)
+		}
+		if sd.Exposed != nil {
+			fmt.Fprintf(&buf, "    exposed: %v -> %v\n", sd.Exposed.Old, sd.Exposed.New)
+		}
+		for _, k := range sortedOptionChangeNames(sd.Options) {
+			oc := sd.Options[k]
+			fmt.Fprintf(&buf, "    option %s: %v -> %v\n", k, oc.Old, oc.New)
+		}
+		for _, k := range sortedStringChangeNames(sd.Annotations) {
+			ac := sd.Annotations[k]
+			fmt.Fprintf(&buf, "    annotation %s: %q -> %q\n", k, ac.Old, ac.New)
+		}
+	}
+	for _, id := range sortedMachineDiffIds(d.Machines) {
+		md := d.Machines[id]
+		switch {
+		case md.Added:
+			fmt.Fprintf(&buf, "+ machine %s (new)\n", id)
+			continue
+		case md.Removed:
+			fmt.Fprintf(&buf, "- machine %s (removed)\n", id)
+			continue
+		}
+		fmt.Fprintf(&buf, "~ machine %s\n", id)
+		if md.Constraints != nil {
+			fmt.Fprintf(&buf, "    constraints: %q -> %q\n", md.Constraints.Old, md.Constraints.New)
+		}
+		for _, k := range sortedStringChangeNames(md.Annotations) {
+			ac := md.Annotations[k]
+			fmt.Fprintf(&buf, "    annotation %s: %q -> %q\n", k, ac.Old, ac.New)
+		}
+	}
+	if d.Relations != nil {
+		for _, rel := range d.Relations.Added {
+			fmt.Fprintf(&buf, "+ relation %s\n", relationKey(rel))
+		}
+		for _, rel := range d.Relations.Removed {
+			fmt.Fprintf(&buf, "- relation %s\n", relationKey(rel))
+		}
+	}
+	return buf.String()
+}
+
+func sortedServiceDiffNames(m map[string]*ServiceDiff) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedMachineDiffIds(m map[string]*MachineDiff) []string {
+	ids := make([]string, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func sortedOptionChangeNames(m map[string]*OptionChange) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedStringChangeNames(m map[string]*StringChange) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DiffBundle compares bd against the currently deployed model
+// described by model and returns a structured report of the
+// differences, without making any changes. It can be used to give
+// operators a dry-run preview before applying a bundle.
+//
+// Unlike the deployment-time checks performed by BundleData.Verify,
+// DiffBundle does not require that every machine or service a
+// placement or relation refers to be declared in bd: such an entity
+// may legitimately already exist in model without being redeclared
+// in the bundle. Nor does it require every machine declared in bd to
+// be referred to by a placement. Other well-formedness problems, such as an
+// unparseable charm URL or malformed constraints, are still reported.
+func DiffBundle(bd *BundleData, model *ModelSnapshot) (*BundleDiff, error) {
+	if err := bd.verifyWellFormed(); err != nil {
+		return nil, fmt.Errorf("cannot diff invalid bundle: %v", err)
+	}
+	if model == nil {
+		model = &ModelSnapshot{}
+	}
+	diff := &BundleDiff{
+		Services: diffServices(bd, model),
+		Machines: diffMachines(bd, model),
+	}
+	if rd := diffRelations(bd, model); rd != nil {
+		diff.Relations = rd
+	}
+	if len(diff.Services) == 0 {
+		diff.Services = nil
+	}
+	if len(diff.Machines) == 0 {
+		diff.Machines = nil
+	}
+	return diff, nil
+}
+
+func diffServices(bd *BundleData, model *ModelSnapshot) map[string]*ServiceDiff {
+	result := make(map[string]*ServiceDiff)
+	for name, svc := range bd.Services {
+		if svc == nil {
+			continue
+		}
+		existing := model.Services[name]
+		if existing == nil {
+			result[name] = &ServiceDiff{Added: true}
+			continue
+		}
+		sd := &ServiceDiff{}
+		if svc.Charm != existing.Charm {
+			sd.Charm = charmChange(existing.Charm, svc.Charm)
+		}
+		if svc.NumUnits != len(existing.Units) {
+			sd.NumUnits = &UnitCountChange{Old: len(existing.Units), New: svc.NumUnits}
+		}
+		sd.UnsatisfiedPlacements = unsatisfiedPlacements(name, svc, model)
+		if svc.Constraints != "" && svc.Constraints != existing.Constraints {
+			sd.Constraints = &StringChange{Old: existing.Constraints, New: svc.Constraints}
+		}
+		if svc.Expose && !existing.Exposed {
+			sd.Exposed = &BoolChange{Old: existing.Exposed, New: svc.Expose}
+		}
+		sd.Options = diffOptions(existing.Options, svc.Options)
+		sd.Annotations = diffAnnotations(existing.Annotations, svc.Annotations)
+		if !sd.isEmpty() {
+			result[name] = sd
+		}
+	}
+	for name := range model.Services {
+		if _, ok := bd.Services[name]; !ok {
+			result[name] = &ServiceDiff{Removed: true}
+		}
+	}
+	return result
+}
+
+// isEmpty reports whether sd describes no differences.
+func (sd *ServiceDiff) isEmpty() bool {
+	return sd.Charm == nil &&
+		sd.NumUnits == nil &&
+		len(sd.UnsatisfiedPlacements) == 0 &&
+		sd.Constraints == nil &&
+		sd.Exposed == nil &&
+		len(sd.Options) == 0 &&
+		len(sd.Annotations) == 0
+}
+
+// charmChange builds a CharmChange describing the move from oldURL
+// to newURL, detecting an upgrade or downgrade when both parse and
+// share the same schema, series and name.
+func charmChange(oldURL, newURL string) *CharmChange {
+	cc := &CharmChange{Old: oldURL, New: newURL}
+	oldU, err1 := ParseURL(oldURL)
+	newU, err2 := ParseURL(newURL)
+	if err1 != nil || err2 != nil {
+		return cc
+	}
+	if oldU.Schema != newU.Schema || oldU.Series != newU.Series || oldU.Name != newU.Name {
+		return cc
+	}
+	if oldU.Revision < newU.Revision {
+		cc.Upgrade = true
+	} else if oldU.Revision > newU.Revision {
+		cc.Downgrade = true
+	}
+	return cc
+}
+
+// unsatisfiedPlacements returns the placement directives from svc.To
+// that are not satisfied by any unit of the service already deployed
+// according to model.
+func unsatisfiedPlacements(name string, svc *ServiceSpec, model *ModelSnapshot) []string {
+	if len(svc.To) == 0 {
+		return nil
+	}
+	existing := model.Services[name]
+	var unsatisfied []string
+	for _, p := range svc.To {
+		up, err := ParsePlacement(p)
+		if err != nil {
+			unsatisfied = append(unsatisfied, p)
+			continue
+		}
+		if placementSatisfied(up, existing, model) {
+			continue
+		}
+		unsatisfied = append(unsatisfied, p)
+	}
+	return unsatisfied
+}
+
+// placementSatisfied reports whether some unit of existing is
+// already placed in a way consistent with up.
+func placementSatisfied(up *UnitPlacement, existing *ServiceSnapshot, model *ModelSnapshot) bool {
+	if existing == nil {
+		return false
+	}
+	// onHost reports whether machine is host itself or, when up names
+	// a container type, a container of that type on host (whose id
+	// has the form "host/type/n").
+	onHost := func(machine, host string) bool {
+		if up.ContainerType == "" {
+			return machine == host
+		}
+		return strings.HasPrefix(machine, host+"/"+up.ContainerType+"/")
+	}
+	switch {
+	case up.Machine == "new":
+		return false
+	case up.Machine != "":
+		for _, u := range existing.Units {
+			if onHost(u.Machine, up.Machine) {
+				return true
+			}
+		}
+		return false
+	case up.Service != "":
+		target := model.Services[up.Service]
+		if target == nil {
+			return false
+		}
+		for _, u := range existing.Units {
+			for tname, tu := range target.Units {
+				if up.Unit >= 0 && tname != fmt.Sprintf("%s/%d", up.Service, up.Unit) {
+					continue
+				}
+				if u.Machine != "" && onHost(u.Machine, tu.Machine) {
+					return true
+				}
+			}
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+func diffOptions(existing, declared map[string]interface{}) map[string]*OptionChange {
+	if len(declared) == 0 {
+		return nil
+	}
+	result := make(map[string]*OptionChange)
+	for k, v := range declared {
+		old, ok := existing[k]
+		if ok && old == v {
+			continue
+		}
+		result[k] = &OptionChange{Old: old, New: v}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+func diffAnnotations(existing, declared map[string]string) map[string]*StringChange {
+	if len(declared) == 0 {
+		return nil
+	}
+	result := make(map[string]*StringChange)
+	for k, v := range declared {
+		old := existing[k]
+		if old == v {
+			continue
+		}
+		result[k] = &StringChange{Old: old, New: v}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+func diffMachines(bd *BundleData, model *ModelSnapshot) map[string]*MachineDiff {
+	result := make(map[string]*MachineDiff)
+	for id, m := range bd.Machines {
+		if m == nil {
+			continue
+		}
+		existing := model.Machines[id]
+		if existing == nil {
+			result[id] = &MachineDiff{Added: true}
+			continue
+		}
+		md := &MachineDiff{}
+		if m.Constraints != "" && m.Constraints != existing.Constraints {
+			md.Constraints = &StringChange{Old: existing.Constraints, New: m.Constraints}
+		}
+		md.Annotations = diffAnnotations(existing.Annotations, m.Annotations)
+		if md.Constraints != nil || len(md.Annotations) > 0 {
+			result[id] = md
+		}
+	}
+	for id := range model.Machines {
+		if _, ok := bd.Machines[id]; !ok {
+			result[id] = &MachineDiff{Removed: true}
+		}
+	}
+	return result
+}
+
+func diffRelations(bd *BundleData, model *ModelSnapshot) *RelationDiff {
+	existing := make(map[string]bool, len(model.Relations))
+	for _, rel := range model.Relations {
+		existing[relationKey(rel)] = true
+	}
+	declared := make(map[string]bool, len(bd.Relations))
+	for _, rel := range bd.Relations {
+		declared[relationKey(rel)] = true
+	}
+	rd := &RelationDiff{}
+	for _, rel := range bd.Relations {
+		if !existing[relationKey(rel)] {
+			rd.Added = append(rd.Added, rel)
+		}
+	}
+	for _, rel := range model.Relations {
+		if !declared[relationKey(rel)] {
+			rd.Removed = append(rd.Removed, rel)
+		}
+	}
+	if len(rd.Added) == 0 && len(rd.Removed) == 0 {
+		return nil
+	}
+	return rd
+}
@@ -0,0 +1,205 @@
+package charm_test
+
+import (
+	jc "github.com/juju/testing/checkers"
+	"gopkg.in/juju/charm.v2"
+	gc "launchpad.net/gocheck"
+)
+
+func (*bundleDataSuite) TestDiffBundleAddedAndRemovedServices(c *gc.C) {
+	bd := &charm.BundleData{
+		Services: map[string]*charm.ServiceSpec{
+			"mysql": {
+				Charm:    "cs:precise/mysql-28",
+				NumUnits: 1,
+			},
+		},
+	}
+	model := &charm.ModelSnapshot{
+		Services: map[string]*charm.ServiceSnapshot{
+			"wordpress": {
+				Charm: "cs:precise/wordpress-10",
+			},
+		},
+	}
+	diff, err := charm.DiffBundle(bd, model)
+	c.Assert(err, gc.IsNil)
+	c.Assert(diff.Empty(), gc.Equals, false)
+	c.Assert(diff.Services["mysql"], jc.DeepEquals, &charm.ServiceDiff{Added: true})
+	c.Assert(diff.Services["wordpress"], jc.DeepEquals, &charm.ServiceDiff{Removed: true})
+}
+
+func (*bundleDataSuite) TestDiffBundleServiceChanges(c *gc.C) {
+	bd := &charm.BundleData{
+		Services: map[string]*charm.ServiceSpec{
+			"mysql": {
+				Charm:    "cs:precise/mysql-28",
+				NumUnits: 2,
+				To:       []string{"0", "new"},
+				Options: map[string]interface{}{
+					"tuning-level": "safest",
+				},
+				Constraints: "mem=2G",
+				Expose:      true,
+			},
+		},
+	}
+	model := &charm.ModelSnapshot{
+		Services: map[string]*charm.ServiceSnapshot{
+			"mysql": {
+				Charm: "cs:precise/mysql-29",
+				Units: map[string]*charm.UnitSnapshot{
+					"mysql/0": {Machine: "0"},
+				},
+				Options:     map[string]interface{}{"tuning-level": "fast"},
+				Constraints: "mem=1G",
+			},
+		},
+	}
+	diff, err := charm.DiffBundle(bd, model)
+	c.Assert(err, gc.IsNil)
+	sd := diff.Services["mysql"]
+	c.Assert(sd, gc.NotNil)
+	c.Assert(sd.Charm, jc.DeepEquals, &charm.CharmChange{
+		Old:       "cs:precise/mysql-29",
+		New:       "cs:precise/mysql-28",
+		Downgrade: true,
+	})
+	c.Assert(sd.NumUnits, jc.DeepEquals, &charm.UnitCountChange{Old: 1, New: 2})
+	c.Assert(sd.UnsatisfiedPlacements, jc.DeepEquals, []string{"new"})
+	c.Assert(sd.Constraints, jc.DeepEquals, &charm.StringChange{Old: "mem=1G", New: "mem=2G"})
+	c.Assert(sd.Exposed, jc.DeepEquals, &charm.BoolChange{Old: false, New: true})
+	c.Assert(sd.Options, jc.DeepEquals, map[string]*charm.OptionChange{
+		"tuning-level": {Old: "fast", New: "safest"},
+	})
+}
+
+func (*bundleDataSuite) TestDiffBundleRespectsCoLocationPlacement(c *gc.C) {
+	bd := &charm.BundleData{
+		Services: map[string]*charm.ServiceSpec{
+			"mysql": {
+				Charm:    "cs:precise/mysql-28",
+				NumUnits: 1,
+			},
+			"wordpress": {
+				Charm:    "cs:precise/wordpress-10",
+				NumUnits: 1,
+				To:       []string{"mysql"},
+			},
+		},
+	}
+	unsatisfied := &charm.ModelSnapshot{
+		Services: map[string]*charm.ServiceSnapshot{
+			"mysql": {
+				Charm: "cs:precise/mysql-28",
+				Units: map[string]*charm.UnitSnapshot{"mysql/0": {Machine: "0"}},
+			},
+			"wordpress": {
+				Charm: "cs:precise/wordpress-10",
+				Units: map[string]*charm.UnitSnapshot{"wordpress/0": {Machine: "1"}},
+			},
+		},
+	}
+	diff, err := charm.DiffBundle(bd, unsatisfied)
+	c.Assert(err, gc.IsNil)
+	c.Assert(diff.Services["wordpress"].UnsatisfiedPlacements, jc.DeepEquals, []string{"mysql"})
+
+	satisfied := &charm.ModelSnapshot{
+		Services: map[string]*charm.ServiceSnapshot{
+			"mysql": {
+				Charm: "cs:precise/mysql-28",
+				Units: map[string]*charm.UnitSnapshot{"mysql/0": {Machine: "0"}},
+			},
+			"wordpress": {
+				Charm: "cs:precise/wordpress-10",
+				Units: map[string]*charm.UnitSnapshot{"wordpress/0": {Machine: "0"}},
+			},
+		},
+	}
+	diff, err = charm.DiffBundle(bd, satisfied)
+	c.Assert(err, gc.IsNil)
+	c.Assert(diff.Services["wordpress"], gc.IsNil)
+}
+
+func (*bundleDataSuite) TestDiffBundleMachinesAndRelations(c *gc.C) {
+	bd := &charm.BundleData{
+		Services: map[string]*charm.ServiceSpec{
+			"mysql": {Charm: "cs:precise/mysql-28", NumUnits: 1},
+		},
+		Machines: map[string]*charm.MachineSpec{
+			"0": {Constraints: "mem=4G"},
+		},
+		Relations: [][]string{
+			{"mysql:db", "wordpress:db"},
+		},
+	}
+	model := &charm.ModelSnapshot{
+		Services: map[string]*charm.ServiceSnapshot{
+			"mysql": {
+				Charm: "cs:precise/mysql-28",
+				Units: map[string]*charm.UnitSnapshot{"mysql/0": {Machine: "0"}},
+			},
+		},
+		Machines: map[string]*charm.MachineSnapshot{
+			"0": {Constraints: "mem=2G"},
+			"1": {},
+		},
+	}
+	diff, err := charm.DiffBundle(bd, model)
+	c.Assert(err, gc.IsNil)
+	c.Assert(diff.Machines["0"].Constraints, jc.DeepEquals, &charm.StringChange{Old: "mem=2G", New: "mem=4G"})
+	c.Assert(diff.Machines["1"], jc.DeepEquals, &charm.MachineDiff{Removed: true})
+	c.Assert(diff.Relations, jc.DeepEquals, &charm.RelationDiff{
+		Added: [][]string{{"mysql:db", "wordpress:db"}},
+	})
+}
+
+func (*bundleDataSuite) TestDiffBundleNoChanges(c *gc.C) {
+	bd := &charm.BundleData{
+		Services: map[string]*charm.ServiceSpec{
+			"mysql": {Charm: "cs:precise/mysql-28", NumUnits: 1},
+		},
+	}
+	model := &charm.ModelSnapshot{
+		Services: map[string]*charm.ServiceSnapshot{
+			"mysql": {
+				Charm: "cs:precise/mysql-28",
+				Units: map[string]*charm.UnitSnapshot{"mysql/0": {Machine: "0"}},
+			},
+		},
+	}
+	diff, err := charm.DiffBundle(bd, model)
+	c.Assert(err, gc.IsNil)
+	c.Assert(diff.Empty(), gc.Equals, true)
+	c.Assert(diff.String(), gc.Equals, "no changes")
+}
+
+// TestDiffBundleDoesNotRequireDeclaredEntities checks that DiffBundle,
+// unlike BundleData.Verify, does not reject a bundle for referring to
+// a machine that is not declared in bd.Machines: such a machine may
+// legitimately already exist in the live model. This is tolerated
+// because DiffBundle's job is to compare against whatever already
+// exists, not to validate the bundle for deployment.
+func (*bundleDataSuite) TestDiffBundleDoesNotRequireDeclaredEntities(c *gc.C) {
+	bd := &charm.BundleData{
+		Services: map[string]*charm.ServiceSpec{
+			"mysql": {Charm: "cs:precise/mysql-28", NumUnits: 1, To: []string{"0"}},
+		},
+	}
+	diff, err := charm.DiffBundle(bd, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(diff.Services["mysql"], jc.DeepEquals, &charm.ServiceDiff{Added: true})
+}
+
+// TestDiffBundleRejectsMalformedBundle checks that DiffBundle still
+// reports well-formedness problems that have nothing to do with live-
+// model completeness, such as a charm URL that fails to parse.
+func (*bundleDataSuite) TestDiffBundleRejectsMalformedBundle(c *gc.C) {
+	bd := &charm.BundleData{
+		Services: map[string]*charm.ServiceSpec{
+			"mysql": {Charm: "bogus!", NumUnits: 1},
+		},
+	}
+	_, err := charm.DiffBundle(bd, nil)
+	c.Assert(err, gc.ErrorMatches, "cannot diff invalid bundle:.*")
+}
@@ -0,0 +1,131 @@
+package charm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// InterpolationError holds the set of errors encountered while
+// interpolating variables into a bundle, one for each variable that
+// could not be resolved.
+type InterpolationError struct {
+	Errors []error
+}
+
+func (err *InterpolationError) Error() string {
+	switch len(err.Errors) {
+	case 0:
+		return "no interpolation errors!"
+	case 1:
+		return err.Errors[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more)", err.Errors[0], len(err.Errors)-1)
+}
+
+// InterpolateBundle reads r and substitutes Compose-style variable
+// references in its content, returning a reader over the result.
+// Variables are looked up with the given lookup function, which
+// should return the variable's value and true if it is set, or
+// ("", false) otherwise. The following forms are recognised:
+//
+//	${VAR}            the value of VAR; an error if VAR is not set
+//	${VAR:-default}   the value of VAR, or default if VAR is not set
+//	${VAR:?message}   the value of VAR; an error including message
+//	                  if VAR is not set
+//	$$                a literal "$"
+//
+// If any required variable cannot be resolved, InterpolateBundle
+// returns an *InterpolationError listing every missing variable.
+func InterpolateBundle(r io.Reader, lookup func(string) (string, bool)) (io.Reader, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read bundle data: %v", err)
+	}
+	out, errs := interpolate(string(data), lookup)
+	if len(errs) > 0 {
+		return nil, &InterpolationError{errs}
+	}
+	return bytes.NewReader([]byte(out)), nil
+}
+
+// ReadBundleDataWithEnv reads r, substituting variable references as
+// described by InterpolateBundle using lookup as the source of
+// values, and parses the result as bundle YAML.
+func ReadBundleDataWithEnv(r io.Reader, lookup func(string) (string, bool)) (*BundleData, error) {
+	interpolated, err := InterpolateBundle(r, lookup)
+	if err != nil {
+		return nil, err
+	}
+	return ReadBundleData(interpolated)
+}
+
+// interpolate scans s for "${...}" variable references and "$$"
+// escapes, substituting values obtained from lookup. It returns the
+// substituted string along with one error per variable reference
+// that could not be resolved.
+func interpolate(s string, lookup func(string) (string, bool)) (string, []error) {
+	var out bytes.Buffer
+	var errs []error
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '$' || i == len(s)-1 {
+			out.WriteByte(c)
+			continue
+		}
+		switch s[i+1] {
+		case '$':
+			out.WriteByte('$')
+			i++
+		case '{':
+			rel := strings.IndexByte(s[i+2:], '}')
+			if rel == -1 {
+				// No closing brace; treat as a literal.
+				out.WriteByte(c)
+				continue
+			}
+			end := i + 2 + rel
+			expr := s[i+2 : end]
+			value, err := resolveVar(expr, lookup)
+			if err != nil {
+				errs = append(errs, err)
+			} else {
+				out.WriteString(value)
+			}
+			i = end
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.String(), errs
+}
+
+// resolveVar resolves a single "${...}" expression (with the
+// surrounding braces already stripped) using lookup, returning the
+// value to substitute or an error describing why it could not be
+// resolved.
+func resolveVar(expr string, lookup func(string) (string, bool)) (string, error) {
+	name := expr
+	op, arg := "", ""
+	if i := strings.IndexByte(expr, ':'); i != -1 && i+1 < len(expr) {
+		switch expr[i+1] {
+		case '-', '?':
+			name = expr[:i]
+			op = string(expr[i+1])
+			arg = expr[i+2:]
+		}
+	}
+	if value, ok := lookup(name); ok {
+		return value, nil
+	}
+	switch op {
+	case "-":
+		return arg, nil
+	case "?":
+		return "", fmt.Errorf("variable %q is not set: %s", name, arg)
+	default:
+		return "", fmt.Errorf("variable %q is not set", name)
+	}
+}
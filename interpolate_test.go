@@ -0,0 +1,78 @@
+package charm_test
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/juju/charm.v2"
+	gc "launchpad.net/gocheck"
+)
+
+func lookupFromMap(m map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := m[name]
+		return v, ok
+	}
+}
+
+func (*bundleDataSuite) TestInterpolateBundle(c *gc.C) {
+	r, err := charm.InterpolateBundle(
+		strings.NewReader("series: ${SERIES}\nnum: $${NOTAVAR}\nflavor: ${FLAVOR:-distro}\n"),
+		lookupFromMap(map[string]string{"SERIES": "precise"}),
+	)
+	c.Assert(err, gc.IsNil)
+	out, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(out), gc.Equals, "series: precise\nnum: ${NOTAVAR}\nflavor: distro\n")
+}
+
+func (*bundleDataSuite) TestInterpolateBundleMissingRequired(c *gc.C) {
+	_, err := charm.InterpolateBundle(
+		strings.NewReader("series: ${SERIES}\ncharm: ${CHARM:?charm must be set}\n"),
+		lookupFromMap(nil),
+	)
+	c.Assert(err, gc.FitsTypeOf, (*charm.InterpolationError)(nil))
+	errs := err.(*charm.InterpolationError).Errors
+	c.Assert(errs, gc.HasLen, 2)
+}
+
+func (*bundleDataSuite) TestReadBundleDataWithEnv(c *gc.C) {
+	data := `
+series: ${SERIES}
+services:
+    wordpress:
+        charm: "cs:${SERIES}/wordpress-10"
+        num_units: 1
+`
+	bd, err := charm.ReadBundleDataWithEnv(
+		strings.NewReader(data),
+		lookupFromMap(map[string]string{"SERIES": "precise"}),
+	)
+	c.Assert(err, gc.IsNil)
+	c.Assert(bd.Series, gc.Equals, "precise")
+	c.Assert(bd.Services["wordpress"].Charm, gc.Equals, "cs:precise/wordpress-10")
+}
+
+func (*bundleDataSuite) TestVerifyUnresolvedVariables(c *gc.C) {
+	data := `
+services:
+    wordpress:
+        charm: "cs:precise/wordpress-10"
+        num_units: 1
+        constraints: "mem=${MEM}"
+        options:
+            name: "${NAME}"
+`
+	bd, err := charm.ReadBundleData(strings.NewReader(data))
+	c.Assert(err, gc.IsNil)
+	err = bd.Verify(nil, nil, nil)
+	c.Assert(err, gc.FitsTypeOf, (*charm.VerificationError)(nil))
+	errs := err.(*charm.VerificationError).Errors
+	found := 0
+	for _, e := range errs {
+		if strings.Contains(e.Error(), "unresolved variable") {
+			found++
+		}
+	}
+	c.Assert(found, gc.Equals, 2)
+}
@@ -0,0 +1,191 @@
+package charm
+
+import (
+	"io"
+	"strings"
+)
+
+// ReadBundleDataWithOverlays reads base as the primary bundle YAML
+// and then reads each of overlays in turn, merging each one on top
+// of the result so far using Merge. The returned BundleData is the
+// result of applying every overlay, in the order given.
+func ReadBundleDataWithOverlays(base io.Reader, overlays ...io.Reader) (*BundleData, error) {
+	bd, err := ReadBundleData(base)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range overlays {
+		overlay, err := ReadBundleData(r)
+		if err != nil {
+			return nil, err
+		}
+		if err := bd.Merge(overlay); err != nil {
+			return nil, err
+		}
+	}
+	return bd, nil
+}
+
+// Merge applies overlay on top of bd, mutating bd in place. Scalar
+// fields in overlay override the corresponding field in bd whenever
+// they are set to a non-zero value; maps are merged key by key, with
+// a null option value in overlay removing that option from bd (a null
+// annotation, storage or device value sets it to the empty string);
+// relations are combined and deduplicated. Merge never removes a
+// service or machine from bd unless overlay explicitly sets it to
+// null.
+func (bd *BundleData) Merge(overlay *BundleData) error {
+	if overlay.Series != "" {
+		bd.Series = overlay.Series
+	}
+	if overlay.DefaultBase != "" {
+		bd.DefaultBase = overlay.DefaultBase
+	}
+	if bd.Services == nil && len(overlay.Services) > 0 {
+		bd.Services = make(map[string]*ServiceSpec)
+	}
+	for name, osvc := range overlay.Services {
+		if osvc == nil {
+			delete(bd.Services, name)
+			continue
+		}
+		svc, ok := bd.Services[name]
+		if !ok || svc == nil {
+			bd.Services[name] = osvc
+			continue
+		}
+		svc.mergeFrom(osvc)
+	}
+	if bd.Machines == nil && len(overlay.Machines) > 0 {
+		bd.Machines = make(map[string]*MachineSpec)
+	}
+	for id, om := range overlay.Machines {
+		if om == nil {
+			delete(bd.Machines, id)
+			continue
+		}
+		m, ok := bd.Machines[id]
+		if !ok || m == nil {
+			bd.Machines[id] = om
+			continue
+		}
+		m.mergeFrom(om)
+	}
+	bd.Relations = mergeRelations(bd.Relations, overlay.Relations)
+	return nil
+}
+
+// mergeFrom merges the fields of overlay into svc, overriding
+// scalars that overlay has set and merging Options, Annotations,
+// Storage and Devices key by key.
+func (svc *ServiceSpec) mergeFrom(overlay *ServiceSpec) {
+	if overlay.Charm != "" {
+		svc.Charm = overlay.Charm
+	}
+	if overlay.Series != "" {
+		svc.Series = overlay.Series
+	}
+	if overlay.Base != "" {
+		svc.Base = overlay.Base
+	}
+	if overlay.NumUnits > 0 {
+		svc.NumUnits = overlay.NumUnits
+	}
+	if overlay.To != nil {
+		svc.To = overlay.To
+	}
+	if overlay.Constraints != "" {
+		svc.Constraints = overlay.Constraints
+	}
+	if overlay.Expose {
+		svc.Expose = true
+	}
+	svc.Options = mergeOptions(svc.Options, overlay.Options)
+	svc.Annotations = mergeAnnotations(svc.Annotations, overlay.Annotations)
+	svc.Storage = mergeAnnotations(svc.Storage, overlay.Storage)
+	svc.Devices = mergeAnnotations(svc.Devices, overlay.Devices)
+}
+
+// mergeFrom merges the fields of overlay into m, overriding scalars
+// that overlay has set and merging Annotations key by key.
+func (m *MachineSpec) mergeFrom(overlay *MachineSpec) {
+	if overlay.Series != "" {
+		m.Series = overlay.Series
+	}
+	if overlay.Base != "" {
+		m.Base = overlay.Base
+	}
+	if overlay.Constraints != "" {
+		m.Constraints = overlay.Constraints
+	}
+	m.Annotations = mergeAnnotations(m.Annotations, overlay.Annotations)
+}
+
+// mergeOptions merges overlay into base, key by key, returning the
+// result. A null value in overlay removes the corresponding key from
+// base.
+func mergeOptions(base, overlay map[string]interface{}) map[string]interface{} {
+	if len(overlay) == 0 {
+		return base
+	}
+	if base == nil {
+		base = make(map[string]interface{}, len(overlay))
+	}
+	for k, v := range overlay {
+		if v == nil {
+			delete(base, k)
+			continue
+		}
+		base[k] = v
+	}
+	return base
+}
+
+// mergeAnnotations merges overlay into base, key by key, returning
+// the result.
+func mergeAnnotations(base, overlay map[string]string) map[string]string {
+	if len(overlay) == 0 {
+		return base
+	}
+	if base == nil {
+		base = make(map[string]string, len(overlay))
+	}
+	for k, v := range overlay {
+		base[k] = v
+	}
+	return base
+}
+
+// mergeRelations appends overlay to base, dropping any relation
+// already present (regardless of endpoint order) so that the same
+// relation is never listed twice.
+func mergeRelations(base, overlay [][]string) [][]string {
+	if len(overlay) == 0 {
+		return base
+	}
+	seen := make(map[string]bool, len(base))
+	for _, rel := range base {
+		seen[relationKey(rel)] = true
+	}
+	for _, rel := range overlay {
+		key := relationKey(rel)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		base = append(base, rel)
+	}
+	return base
+}
+
+// relationKey returns a key that identifies rel regardless of the
+// order of its endpoints.
+func relationKey(rel []string) string {
+	if len(rel) != 2 {
+		return strings.Join(rel, " ")
+	}
+	if rel[1] < rel[0] {
+		return rel[1] + " " + rel[0]
+	}
+	return rel[0] + " " + rel[1]
+}
@@ -0,0 +1,111 @@
+package charm_test
+
+import (
+	"strings"
+	"testing"
+
+	jc "github.com/juju/testing/checkers"
+	"gopkg.in/juju/charm.v2"
+	gc "launchpad.net/gocheck"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+const wordpressBase = `
+series: precise
+services:
+    wordpress:
+        charm: "cs:precise/wordpress-10"
+        num_units: 1
+        options:
+            debug: false
+        annotations:
+            "gui-x": "100"
+    mysql:
+        charm: "cs:precise/mysql-28"
+        num_units: 1
+relations:
+    - ["wordpress:db", "mysql:db"]
+`
+
+func (*bundleDataSuite) TestReadBundleDataWithOverlaysNoOverlays(c *gc.C) {
+	bd, err := charm.ReadBundleDataWithOverlays(strings.NewReader(wordpressBase))
+	c.Assert(err, gc.IsNil)
+	want, err := charm.ReadBundleData(strings.NewReader(wordpressBase))
+	c.Assert(err, gc.IsNil)
+	c.Assert(bd, jc.DeepEquals, want)
+}
+
+func (*bundleDataSuite) TestReadBundleDataWithOverlaysMergesScalarsAndMaps(c *gc.C) {
+	overlay := `
+services:
+    wordpress:
+        options:
+            debug: true
+        annotations:
+            "gui-y": "200"
+    mysql:
+        num_units: 2
+`
+	bd, err := charm.ReadBundleDataWithOverlays(
+		strings.NewReader(wordpressBase),
+		strings.NewReader(overlay),
+	)
+	c.Assert(err, gc.IsNil)
+	c.Assert(bd.Services["wordpress"].Options, jc.DeepEquals, map[string]interface{}{
+		"debug": true,
+	})
+	c.Assert(bd.Services["wordpress"].Annotations, jc.DeepEquals, map[string]string{
+		"gui-x": "100",
+		"gui-y": "200",
+	})
+	c.Assert(bd.Services["mysql"].NumUnits, gc.Equals, 2)
+}
+
+func (*bundleDataSuite) TestReadBundleDataWithOverlaysRemovesService(c *gc.C) {
+	overlay := `
+services:
+    mysql: ~
+`
+	bd, err := charm.ReadBundleDataWithOverlays(
+		strings.NewReader(wordpressBase),
+		strings.NewReader(overlay),
+	)
+	c.Assert(err, gc.IsNil)
+	_, ok := bd.Services["mysql"]
+	c.Assert(ok, gc.Equals, false)
+	_, ok = bd.Services["wordpress"]
+	c.Assert(ok, gc.Equals, true)
+}
+
+func (*bundleDataSuite) TestReadBundleDataWithOverlaysAddsService(c *gc.C) {
+	overlay := `
+services:
+    varnish:
+        charm: "cs:precise/varnish-1"
+        num_units: 1
+`
+	bd, err := charm.ReadBundleDataWithOverlays(
+		strings.NewReader(wordpressBase),
+		strings.NewReader(overlay),
+	)
+	c.Assert(err, gc.IsNil)
+	c.Assert(bd.Services["varnish"].Charm, gc.Equals, "cs:precise/varnish-1")
+}
+
+func (*bundleDataSuite) TestReadBundleDataWithOverlaysDedupesRelations(c *gc.C) {
+	overlay := `
+relations:
+    - ["wordpress:db", "mysql:db"]
+    - ["wordpress:cache", "varnish:webcache"]
+`
+	bd, err := charm.ReadBundleDataWithOverlays(
+		strings.NewReader(wordpressBase),
+		strings.NewReader(overlay),
+	)
+	c.Assert(err, gc.IsNil)
+	c.Assert(bd.Relations, jc.DeepEquals, [][]string{
+		{"wordpress:db", "mysql:db"},
+		{"wordpress:cache", "varnish:webcache"},
+	})
+}
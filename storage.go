@@ -0,0 +1,142 @@
+package charm
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// StorageConstraint holds a parsed storage constraint, as found in
+// the value of a ServiceSpec's Storage map.
+type StorageConstraint struct {
+	// Pool holds the name of the storage pool to allocate from, or
+	// the empty string if the default pool should be used.
+	Pool string
+
+	// Count holds the number of storage instances to create. It
+	// defaults to 1 if not specified.
+	Count uint64
+
+	// Size holds the minimum size of each storage instance, in
+	// mebibytes, or zero if unspecified.
+	Size uint64
+}
+
+var (
+	validStoragePool  = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9-]*$`)
+	validStorageCount = regexp.MustCompile(`^[0-9]+$`)
+	validStorageSize  = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)([MGTP])$`)
+)
+
+var storageSizeMultiplier = map[string]uint64{
+	"M": 1,
+	"G": 1024,
+	"T": 1024 * 1024,
+	"P": 1024 * 1024 * 1024,
+}
+
+// ParseStorageConstraints parses a storage constraint string, as
+// found in the "storage:" section of a service specification. The
+// string holds a comma-separated list of a storage pool name, a
+// count and a size (each optional, in any order), for example
+// "ebs,1,10G" or simply "10G".
+func ParseStorageConstraints(s string) (StorageConstraint, error) {
+	var sc StorageConstraint
+	haveCount, haveSize := false, false
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		switch {
+		case validStorageCount.MatchString(field):
+			if haveCount {
+				return StorageConstraint{}, fmt.Errorf("cannot specify storage count twice in %q", s)
+			}
+			n, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return StorageConstraint{}, fmt.Errorf("invalid storage count %q: %v", field, err)
+			}
+			sc.Count = n
+			haveCount = true
+		case validStorageSize.MatchString(field):
+			if haveSize {
+				return StorageConstraint{}, fmt.Errorf("cannot specify storage size twice in %q", s)
+			}
+			size, err := parseStorageSize(field)
+			if err != nil {
+				return StorageConstraint{}, err
+			}
+			sc.Size = size
+			haveSize = true
+		case validStoragePool.MatchString(field):
+			if sc.Pool != "" {
+				return StorageConstraint{}, fmt.Errorf("cannot specify storage pool twice in %q", s)
+			}
+			sc.Pool = field
+		default:
+			return StorageConstraint{}, fmt.Errorf("invalid storage constraint %q", field)
+		}
+	}
+	if !haveCount {
+		sc.Count = 1
+	}
+	return sc, nil
+}
+
+func parseStorageSize(field string) (uint64, error) {
+	m := validStorageSize.FindStringSubmatch(field)
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid storage size %q: %v", field, err)
+	}
+	return uint64(n * float64(storageSizeMultiplier[m[2]])), nil
+}
+
+// DeviceConstraint holds a parsed device constraint, as found in the
+// value of a ServiceSpec's Devices map.
+type DeviceConstraint struct {
+	// Type holds the device type or class, for example
+	// "nvidia.com/gpu".
+	Type string
+
+	// Count holds the number of devices to allocate. It defaults
+	// to 1 if not specified.
+	Count int64
+
+	// Attributes holds any additional selector attributes required
+	// of the device.
+	Attributes map[string]string
+}
+
+// ParseDeviceConstraints parses a device constraint string, as found
+// in the "devices:" section of a service specification. The string
+// holds the device type, optionally followed by a count and a
+// semicolon-separated list of "key=value" attributes, each separated
+// by a comma, for example "nvidia.com/gpu,2,vendor=nvidia;model=t4".
+func ParseDeviceConstraints(s string) (DeviceConstraint, error) {
+	fields := strings.SplitN(s, ",", 3)
+	if fields[0] == "" {
+		return DeviceConstraint{}, fmt.Errorf("empty device type in %q", s)
+	}
+	dc := DeviceConstraint{Type: fields[0], Count: 1}
+	if len(fields) > 1 && fields[1] != "" {
+		n, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return DeviceConstraint{}, fmt.Errorf("invalid device count %q: %v", fields[1], err)
+		}
+		dc.Count = n
+	}
+	if len(fields) > 2 && fields[2] != "" {
+		dc.Attributes = make(map[string]string)
+		for _, kv := range strings.Split(fields[2], ";") {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return DeviceConstraint{}, fmt.Errorf("invalid device attribute %q in %q", kv, s)
+			}
+			dc.Attributes[parts[0]] = parts[1]
+		}
+	}
+	return dc, nil
+}
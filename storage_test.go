@@ -0,0 +1,157 @@
+package charm_test
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	jc "github.com/juju/testing/checkers"
+	"gopkg.in/juju/charm.v2"
+	gc "launchpad.net/gocheck"
+)
+
+var storageConstraintsTests = []struct {
+	about       string
+	constraints string
+	expect      charm.StorageConstraint
+	expectErr   string
+}{{
+	about:       "pool, count and size",
+	constraints: "ebs,1,10G",
+	expect:      charm.StorageConstraint{Pool: "ebs", Count: 1, Size: 10 * 1024},
+}, {
+	about:       "size only",
+	constraints: "10G",
+	expect:      charm.StorageConstraint{Count: 1, Size: 10 * 1024},
+}, {
+	about:       "count defaults to 1",
+	constraints: "ebs",
+	expect:      charm.StorageConstraint{Pool: "ebs", Count: 1},
+}, {
+	about:       "explicit count",
+	constraints: "ebs,3",
+	expect:      charm.StorageConstraint{Pool: "ebs", Count: 3},
+}, {
+	about:       "megabytes",
+	constraints: "100M",
+	expect:      charm.StorageConstraint{Count: 1, Size: 100},
+}, {
+	about:       "duplicate pool",
+	constraints: "ebs,rootfs",
+	expectErr:   `cannot specify storage pool twice in "ebs,rootfs"`,
+}, {
+	about:       "invalid field",
+	constraints: "ebs,1,10G,bogus!",
+	expectErr:   `invalid storage constraint "bogus!"`,
+}}
+
+func (*bundleDataSuite) TestParseStorageConstraints(c *gc.C) {
+	for i, test := range storageConstraintsTests {
+		c.Logf("test %d: %s", i, test.about)
+		sc, err := charm.ParseStorageConstraints(test.constraints)
+		if test.expectErr != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectErr)
+			continue
+		}
+		c.Assert(err, gc.IsNil)
+		c.Assert(sc, jc.DeepEquals, test.expect)
+	}
+}
+
+var deviceConstraintsTests = []struct {
+	about       string
+	constraints string
+	expect      charm.DeviceConstraint
+	expectErr   string
+}{{
+	about:       "type only",
+	constraints: "nvidia.com/gpu",
+	expect:      charm.DeviceConstraint{Type: "nvidia.com/gpu", Count: 1},
+}, {
+	about:       "type and count",
+	constraints: "nvidia.com/gpu,2",
+	expect:      charm.DeviceConstraint{Type: "nvidia.com/gpu", Count: 2},
+}, {
+	about:       "type, count and attributes",
+	constraints: "nvidia.com/gpu,2,vendor=nvidia;model=t4",
+	expect: charm.DeviceConstraint{
+		Type:  "nvidia.com/gpu",
+		Count: 2,
+		Attributes: map[string]string{
+			"vendor": "nvidia",
+			"model":  "t4",
+		},
+	},
+}, {
+	about:       "empty type",
+	constraints: "",
+	expectErr:   `empty device type in ""`,
+}, {
+	about:       "invalid attribute",
+	constraints: "nvidia.com/gpu,2,bogus",
+	expectErr:   `invalid device attribute "bogus" in "nvidia.com/gpu,2,bogus"`,
+}}
+
+func (*bundleDataSuite) TestParseDeviceConstraints(c *gc.C) {
+	for i, test := range deviceConstraintsTests {
+		c.Logf("test %d: %s", i, test.about)
+		dc, err := charm.ParseDeviceConstraints(test.constraints)
+		if test.expectErr != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectErr)
+			continue
+		}
+		c.Assert(err, gc.IsNil)
+		c.Assert(dc, jc.DeepEquals, test.expect)
+	}
+}
+
+func (*bundleDataSuite) TestVerifyStorageAndDevices(c *gc.C) {
+	data := `
+services:
+    mysql:
+        charm: "cs:precise/mysql-28"
+        num_units: 1
+        storage:
+            data: "ebs,1,10G"
+            logs: "bogus!"
+        devices:
+            gpu: "nvidia.com/gpu"
+            tpu: "nvidia.com/tpu,bogus"
+`
+	bd, err := charm.ReadBundleData(strings.NewReader(data))
+	c.Assert(err, gc.IsNil)
+
+	err = bd.Verify(nil, nil, nil)
+	c.Assert(err, gc.FitsTypeOf, (*charm.VerificationError)(nil))
+	errs := err.(*charm.VerificationError).Errors
+	errStrings := make([]string, len(errs))
+	for i, e := range errs {
+		errStrings[i] = e.Error()
+	}
+	expectErrs := []string{
+		`invalid storage "logs" in service "mysql": invalid storage constraint "bogus!"`,
+		`invalid device "tpu" in service "mysql": invalid device count "bogus": strconv.ParseInt: parsing "bogus": invalid syntax`,
+	}
+	sort.Strings(errStrings)
+	sort.Strings(expectErrs)
+	c.Assert(errStrings, jc.DeepEquals, expectErrs)
+
+	err = bd.Verify(
+		nil,
+		func(c string) error {
+			if c == "ebs,1,10G" {
+				return fmt.Errorf("pool not available here")
+			}
+			return nil
+		},
+		nil,
+	)
+	errs = err.(*charm.VerificationError).Errors
+	found := false
+	for _, e := range errs {
+		if e.Error() == `invalid storage "data" in service "mysql": pool not available here` {
+			found = true
+		}
+	}
+	c.Assert(found, gc.Equals, true)
+}
@@ -0,0 +1,76 @@
+package charm
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// URL represents a charm or bundle identifier as used throughout the
+// bundle and charm metadata: an optional schema, an optional series,
+// a name, and an optional revision (e.g. "cs:precise/mysql-28").
+type URL struct {
+	Schema   string
+	Series   string
+	Name     string
+	Revision int // -1 if unspecified
+}
+
+var validCharmName = regexp.MustCompile(`^[a-z][a-z0-9]*(-[a-z0-9]+)*$`)
+
+// ParseURL parses the given string as a charm URL. Unlike most charm
+// URLs found in the wild, the schema may be omitted, in which case
+// "cs" is assumed.
+func ParseURL(s string) (*URL, error) {
+	orig := s
+	u := &URL{
+		Schema:   "cs",
+		Revision: -1,
+	}
+	if i := strings.Index(s, ":"); i != -1 {
+		schema := s[:i]
+		if schema != "cs" && schema != "local" {
+			return nil, fmt.Errorf("charm URL has invalid schema: %q", orig)
+		}
+		u.Schema = schema
+		s = s[i+1:]
+	}
+	parts := strings.Split(s, "/")
+	switch len(parts) {
+	case 1:
+		s = parts[0]
+	case 2:
+		u.Series = parts[0]
+		s = parts[1]
+	default:
+		return nil, fmt.Errorf("charm URL has invalid form: %q", orig)
+	}
+	if u.Series != "" && !validSeries.MatchString(u.Series) {
+		return nil, fmt.Errorf("charm URL has invalid series: %q", orig)
+	}
+	if i := strings.LastIndex(s, "-"); i != -1 {
+		if rev, err := strconv.Atoi(s[i+1:]); err == nil {
+			u.Revision = rev
+			s = s[:i]
+		}
+	}
+	if !validCharmName.MatchString(s) {
+		return nil, fmt.Errorf("charm URL has invalid name: %q", orig)
+	}
+	u.Name = s
+	return u, nil
+}
+
+func (u *URL) String() string {
+	var parts []string
+	if u.Series != "" {
+		parts = append(parts, u.Series)
+	}
+	name := u.Name
+	if u.Revision >= 0 {
+		name = fmt.Sprintf("%s-%d", name, u.Revision)
+	}
+	parts = append(parts, name)
+	return fmt.Sprintf("%s:%s", u.Schema, strings.Join(parts, "/"))
+}